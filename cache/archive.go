@@ -0,0 +1,355 @@
+package cache
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression formats for archives.
+const (
+	CompressNone = "none"
+	CompressGzip = "gzip"
+	CompressZstd = "zstd"
+)
+
+// SourceDateEpochEnv names the environment variable with the time, in seconds
+// since the Unix epoch, WriteArchive clamps modification times to.
+const SourceDateEpochEnv = "SOURCE_DATE_EPOCH"
+
+// clampedRecord marks the archive members whose modification time was
+// clamped, so extraction leaves them at their real (extraction) time.
+const clampedRecord = "CACHEPKGS.clamped"
+
+// sourceDateEpoch returns the time $SOURCE_DATE_EPOCH is set to, or the
+// zero time if it isn't.
+func sourceDateEpoch() (time.Time, error) {
+	v := os.Getenv(SourceDateEpochEnv)
+	if v == "" {
+		return time.Time{}, nil
+	}
+	sec, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("bad $%s %q, want seconds since the epoch", SourceDateEpochEnv, v)
+	}
+	return time.Unix(sec, 0), nil
+}
+
+// zstdMagic starts every zstd frame.
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+// compressWriter wraps w to compress with compression.
+func compressWriter(w io.Writer, compression string) (io.WriteCloser, error) {
+	switch compression {
+	case CompressNone:
+		return nopWriteCloser{w}, nil
+	case CompressGzip:
+		return gzip.NewWriter(w), nil
+	case CompressZstd:
+		return zstd.NewWriter(w)
+	}
+	return nil, CheckCompression(compression)
+}
+
+// CheckCompression returns an error unless compression is known.
+func CheckCompression(compression string) error {
+	switch compression {
+	case CompressNone, CompressGzip, CompressZstd:
+		return nil
+	}
+	return fmt.Errorf("unknown compression %q (use one of %s, %s or %s)", compression, CompressNone, CompressGzip, CompressZstd)
+}
+
+// decompressReader wraps r to decompress whichever format it is in.
+func decompressReader(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(len(zstdMagic))
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		return gzip.NewReader(br)
+	case bytes.Equal(magic, zstdMagic):
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	}
+	return io.NopCloser(br), nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// WriteArchive writes the tree at dir to w as a tar compressed with
+// compression. Modes, modification times and symlinks within the tree are
+// preserved.
+//
+// With $SOURCE_DATE_EPOCH set the archive is reproducible: modification
+// times later than it are clamped to it and owners are left out, so the
+// same tree gives the same bytes on any machine. The paths are always in
+// lexical order.
+//
+// Given several dirs, the archive root is a directory holding each of them
+// in the subdir named by its index, the layout of entries with multiple
+// outputs (see outputDir).
+func WriteArchive(w io.Writer, compression string, dirs ...string) error {
+	return writeArchive(w, compression, nil, dirs...)
+}
+
+// writeArchive is WriteArchive, leaving out the paths of dirs[i] matching
+// excludes[i], see excluded. excludes may be shorter than dirs.
+func writeArchive(w io.Writer, compression string, excludes [][]string, dirs ...string) error {
+	clamp, err := sourceDateEpoch()
+	if err != nil {
+		return err
+	}
+	zw, err := compressWriter(w, compression)
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(zw)
+
+	if len(dirs) == 1 {
+		err = addTree(tw, dirs[0], "", excludeOf(excludes, 0), clamp)
+	} else {
+		root := &tar.Header{
+			Typeflag: tar.TypeDir,
+			Name:     "./",
+			Mode:     0755,
+			ModTime:  time.Now(),
+		}
+		clampHeader(root, clamp)
+		err = tw.WriteHeader(root)
+		for i := 0; err == nil && i < len(dirs); i++ {
+			err = addTree(tw, dirs[i], strconv.Itoa(i)+"/", excludeOf(excludes, i), clamp)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	err = tw.Close()
+	if err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// excludeOf returns the exclude patterns of the i'th dir.
+func excludeOf(excludes [][]string, i int) []string {
+	if i < len(excludes) {
+		return excludes[i]
+	}
+	return nil
+}
+
+// clampHeader makes hdr reproducible for the $SOURCE_DATE_EPOCH clamp, if
+// it isn't zero.
+func clampHeader(hdr *tar.Header, clamp time.Time) {
+	if clamp.IsZero() {
+		return
+	}
+	hdr.Uid, hdr.Gid, hdr.Uname, hdr.Gname = 0, 0, "", ""
+	if hdr.ModTime.After(clamp) {
+		hdr.ModTime = clamp
+		hdr.PAXRecords = map[string]string{clampedRecord: "1"}
+	}
+}
+
+// addTree adds the tree at dir to tw, with all names prefixed by prefix and
+// modification times clamped to clamp unless that is zero.
+func addTree(tw *tar.Writer, dir, prefix string, exclude []string, clamp time.Time) error {
+	return filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		if rel != "." && excluded(filepath.ToSlash(rel), info.IsDir(), exclude) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		var link string
+		switch mode := info.Mode(); {
+		case mode&os.ModeSymlink != 0:
+			link, err = os.Readlink(p)
+			if err != nil {
+				return err
+			}
+		case !mode.IsDir() && !mode.IsRegular():
+			// same as Copy, nothing but files, dirs and symlinks
+			return nil
+		}
+
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = prefix + filepath.ToSlash(rel)
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+		clampHeader(hdr, clamp)
+		err = tw.WriteHeader(hdr)
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+}
+
+// writeArchiveFile writes the trees at dirs to the archive file p, see
+// writeArchive.
+func writeArchiveFile(p, compression string, excludes [][]string, dirs ...string) error {
+	f, err := os.Create(p)
+	if err != nil {
+		return err
+	}
+	err = writeArchive(f, compression, excludes, dirs...)
+	if errClose := f.Close(); err == nil {
+		err = errClose
+	}
+	if err != nil {
+		os.Remove(p)
+	}
+	return err
+}
+
+// ExtractArchive extracts the tar read from r to dir, which must not exist
+// yet. The compression format is detected from the archive itself. If
+// extraction fails dir is removed again.
+func ExtractArchive(r io.Reader, dir string) error {
+	err := extract(r, dir)
+	if err != nil {
+		errRm := os.RemoveAll(dir)
+		if errRm != nil && !os.IsNotExist(errRm) {
+			return errRm
+		}
+	}
+	return err
+}
+
+func extract(r io.Reader, dir string) error {
+	zr, err := decompressReader(r)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+	tr := tar.NewReader(zr)
+
+	err = os.Mkdir(dir, 0700)
+	if err != nil {
+		return err
+	}
+
+	// Only write into dirs extracted from the archive. That way an entry
+	// can't escape dir through a symlink extracted earlier.
+	dirs := map[string]*tar.Header{".": {Mode: 0755}}
+	var order []string
+	folds := newCaseFolds()
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		name := path.Clean(hdr.Name)
+		if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return fmt.Errorf("archive entry %q is outside the archive", hdr.Name)
+		}
+		if _, ok := dirs[path.Dir(name)]; !ok {
+			return fmt.Errorf("archive entry %q is not inside an archived directory", hdr.Name)
+		}
+		target := filepath.Join(dir, filepath.FromSlash(name))
+		err = folds.check(name, target)
+		if err != nil {
+			return err
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if name == "." {
+				dirs[name] = hdr
+				continue
+			}
+			err = os.Mkdir(target, 0700)
+			dirs[name] = hdr
+			order = append(order, name)
+		case tar.TypeSymlink:
+			err = os.Symlink(hdr.Linkname, target)
+		case tar.TypeReg:
+			err = extractFile(tr, target, hdr)
+		default:
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// like Copy, deepest dirs first so their mtimes stick
+	order = append([]string{"."}, order...)
+	for i := len(order) - 1; i >= 0; i-- {
+		hdr := dirs[order[i]]
+		err := setHeaderMetadata(filepath.Join(dir, filepath.FromSlash(order[i])), hdr)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func extractFile(r io.Reader, target string, hdr *tar.Header) error {
+	f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if errClose := f.Close(); err == nil {
+		err = errClose
+	}
+	if err != nil {
+		return err
+	}
+	return setHeaderMetadata(target, hdr)
+}
+
+func setHeaderMetadata(p string, hdr *tar.Header) error {
+	if hdr.ModTime.IsZero() || hdr.PAXRecords[clampedRecord] != "" {
+		// the root dir when the archive has no entry for it, or a time
+		// that is only there for reproducibility
+		return os.Chmod(p, hdr.FileInfo().Mode().Perm())
+	}
+	return copyMetadata(p, hdr.FileInfo(), false)
+}
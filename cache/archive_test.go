@@ -0,0 +1,72 @@
+package cache
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// benchTree writes a tree shaped like a dependency dir to a new dir: many
+// small files in nested packages and a few larger ones.
+func benchTree(b *testing.B) string {
+	b.Helper()
+	src := filepath.Join(b.TempDir(), "src")
+	small, large := strings.Repeat("module.exports = {};\n", 50), strings.Repeat("x", 1<<20)
+	for pkg := 0; pkg < 50; pkg++ {
+		for f := 0; f < 20; f++ {
+			p := filepath.Join(src, fmt.Sprintf("pkg%d", pkg), "lib", fmt.Sprintf("f%d.js", f))
+			err := writeFile(p, small, 0644)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	for f := 0; f < 4; f++ {
+		err := writeFile(filepath.Join(src, "bin", fmt.Sprintf("large%d", f)), large, 0755)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	return src
+}
+
+// benchInstall runs install to a new dir for each of b.N iterations,
+// removing it again outside of the timing.
+func benchInstall(b *testing.B, install func(dst string) error) {
+	b.Helper()
+	dst := filepath.Join(b.TempDir(), "dst")
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err := install(dst)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.StopTimer()
+		os.RemoveAll(dst)
+		b.StartTimer()
+	}
+}
+
+// BenchmarkInstall compares installing an unpacked entry by copying it
+// with extracting an archived one.
+func BenchmarkInstall(b *testing.B) {
+	src := benchTree(b)
+	b.Run("copy", func(b *testing.B) {
+		benchInstall(b, func(dst string) error { return Copy(src, dst) })
+	})
+	for _, tc := range []struct{ name, compression string }{
+		{"tar", CompressNone},
+		{"tar+zstd", CompressZstd},
+	} {
+		b.Run(tc.name, func(b *testing.B) {
+			archive := filepath.Join(b.TempDir(), "entry"+archiveExt)
+			err := writeArchiveFile(archive, tc.compression, nil, src)
+			if err != nil {
+				b.Fatal(err)
+			}
+			benchInstall(b, func(dst string) error { return extractArchiveFile(archive, dst) })
+		})
+	}
+}
@@ -0,0 +1,848 @@
+// Package cache caches directories generated from dependency descriptions,
+// e.g. node_modules from package.json. It is what the cache-pkgs command is
+// built on.
+//
+// A cache store is a dir holding one entry per key. The key is the hash of
+// the dependency descriptions (see KeySpec) and the entry is the tree that
+// was generated from them, or an archive of it. Each entry comes with a
+// manifest recording how it was made.
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Cache is a cache store and the policy for adding entries to it.
+type Cache struct {
+	// Dir is the cache store.
+	Dir string
+	// Hash is the algorithm keys are computed with, see HashAlgoNames.
+	Hash string
+	// Namespace partitions the store, its entries are kept in a subdir of
+	// Dir and prefixed by it on Remote. See ValidNamespace.
+	Namespace string
+
+	InstallOptions
+
+	// Archive stores new entries as a single archive compressed with
+	// Compression rather than as an unpacked tree. Compression also
+	// applies to uploads to Remote.
+	Archive     bool
+	Compression string
+	// CAS stores new entries content addressed, keeping identical files
+	// once across all entries. They are installed by hardlinking, or
+	// copying with InstallCopy.
+	CAS bool
+	// Verify records a digest of new entries and checks it before
+	// installing, regenerating entries that don't match.
+	Verify bool
+	// Force removes existing outputs instead of failing.
+	Force bool
+	// Idempotent replaces outputs symlinked to another entry of the store,
+	// as left by a run on older dependency descriptions, rather than
+	// failing. On a hit the new link is renamed over the old one, so the
+	// output never goes missing. Outputs already linking to the entry are
+	// kept as they always are. It only applies with InstallSymlink.
+	Idempotent bool
+	// LockTimeout bounds the wait for another process generating the same
+	// entry. 0 waits forever.
+	LockTimeout time.Duration
+	// Timeout stops the generation command if it runs longer. 0 never
+	// does.
+	Timeout time.Duration
+	// RunDir is the working dir of the generation command, if not the
+	// current one. Outputs are still relative to the current dir.
+	RunDir string
+	// AcceptExitCodes are exit codes of the command, besides 0, whose
+	// output is cached all the same. EnsureInstalled then returns an
+	// AcceptedExitError.
+	AcceptExitCodes []int
+	// Retries is how often a failing command is run again, waiting
+	// longer before each retry. Outputs are removed before a retry unless
+	// merging.
+	Retries int
+	// SkipCommandCheck runs the command on a miss without first checking
+	// that it is in PATH.
+	SkipCommandCheck bool
+	// FailOnMiss makes EnsureInstalled fail with ErrNotCached rather than
+	// run the command when the entry is neither in the store nor the
+	// Remote, for stages which must only install what earlier ones cached.
+	FailOnMiss bool
+	// PreGenerate is run before the command on a miss and PostInstall
+	// after installing a hit, e.g. to rebuild native addons. Either failing
+	// fails the run. Note that with InstallSymlink PostInstall works on the
+	// cached tree itself.
+	PreGenerate []string
+	PostInstall []string
+	// Remote, if set, is tried on misses and sent new entries.
+	Remote Remote
+	// AsyncPush sends new entries to Remote in the background, so
+	// EnsureInstalled returns without waiting on the upload. WaitPushes
+	// must be called before exiting to let them finish. Failed pushes are
+	// only reported, as they always are.
+	AsyncPush bool
+	pushes    sync.WaitGroup
+	// MaxSize evicts the least recently used entries once the store grows
+	// beyond it. 0 never does.
+	MaxSize int64
+	// MtimeShortcut remembers the hashes of dependency descriptions in
+	// the store by their size and modification time, and skips rehashing
+	// them while those are unchanged.
+	MtimeShortcut bool
+	// ReadOnly never writes to the store, nor pushes to Remote. Hits are
+	// installed, misses generate the outputs without caching them.
+	ReadOnly bool
+	// OnEvent, if set, is called synchronously with each CacheEvent, e.g.
+	// to count hits and misses. The events written to Log are unaffected.
+	OnEvent func(CacheEvent)
+}
+
+// New returns a Cache for the store dir, creating it if needed, with the
+// defaults of the cache-pkgs command. With dir empty StoreDir picks it.
+func New(dir string) (*Cache, error) {
+	dir, err := StoreDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	err = CreateStore(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &Cache{
+		Dir:            dir,
+		Hash:           "sha256",
+		InstallOptions: InstallOptions{Mode: InstallSymlink},
+		Compression:    CompressGzip,
+		MtimeShortcut:  true,
+	}, nil
+}
+
+// StoreDir returns the cache store to use. An explicit dirName wins over
+// $CACHE_DIR, which wins over ~/.dep-cache.
+func StoreDir(dirName string) (dir string, err error) {
+	dir = dirName
+
+	if dir == "" {
+		dir = os.Getenv("CACHE_DIR")
+	}
+
+	if dir == "" {
+		// %USERPROFILE% on Windows, $HOME elsewhere
+		home, _ := os.UserHomeDir()
+		if home == "" {
+			// os/user uses cgo. Fails under cross-compile.
+			u, err := user.Current()
+			if err != nil {
+				return "", err
+			}
+			home = u.HomeDir
+		}
+		dir = filepath.Join(home, ".dep-cache")
+	}
+	return dir, nil
+}
+
+// ErrNotADir is wrapped by the error of CreateStore when the store is
+// something else than a directory.
+var ErrNotADir = errors.New("exists but is not a dir")
+
+// CreateStore creates the cache store dir unless it exists.
+func CreateStore(dir string) error {
+	info, err := os.Stat(dir)
+	if os.IsNotExist(err) {
+		Progress("creating cache dir", dir)
+		return mkdirStore(dir)
+	}
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s %w", dir, ErrNotADir)
+	}
+	return nil
+}
+
+// Get returns the path of the entry for key, the dir or for archived
+// entries the archive. Content addressed entries are their index.
+func (c *Cache) Get(key string) (path string, ok bool) {
+	dir := filepath.Join(c.NamespaceDir(), key)
+	for _, p := range []string{archivePath(dir), casPath(dir)} {
+		if _, err := os.Stat(p); err == nil {
+			return p, true
+		}
+	}
+	ok, err := IsDir(dir)
+	if err != nil || !ok {
+		return "", false
+	}
+	return dir, true
+}
+
+// Put caches the tree at dir under key, unless there already is an entry
+// for it.
+func (c *Cache) Put(key, dir string) error {
+	if c.ReadOnly {
+		return ErrReadOnly
+	}
+	entry := filepath.Join(c.NamespaceDir(), key)
+	lock, err := LockEntry(entry, c.LockTimeout)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	if _, ok := c.Get(key); ok {
+		return nil
+	}
+	m := &Manifest{Hash: c.Hash, Version: Version}
+	return c.store(entry, []string{dir}, m)
+}
+
+// EnsureInstalled installs the entry for k to outputs, generating it with
+// cmd first if it isn't cached. It reports whether the entry was cached.
+//
+// Outputs must not exist unless Force or Merge is set, or they are symlinks
+// to the entry already. When merging on a miss, whatever was in the outputs
+// before the command ran is cached along with what it generated. With k.Key
+// or FailOnMiss set cmd may be empty, a miss is an error then.
+func (c *Cache) EnsureInstalled(k KeySpec, outputs, cmd []string) (hit bool, err error) {
+	if len(outputs) == 0 || len(cmd) == 0 && k.Key == "" && !c.FailOnMiss {
+		return false, errors.New("no outputs or command given")
+	}
+	if c.Merge && c.Mode == InstallSymlink {
+		return false, errMergeSymlink
+	}
+	if len(c.Rewrite) > 0 && c.Mode == InstallSymlink {
+		return false, errRewriteSymlink
+	}
+
+	// timings of this entry only
+	Log.TakeTimings()
+	lookupStart := time.Now()
+	done := Step("hashing")
+	keys, err := c.keys(k)
+	if err != nil {
+		return false, fmt.Errorf("can't hash dependency description: %w", err)
+	}
+	done()
+
+	// pre build
+	var linked []int
+	for i, outputdir := range outputs {
+		if c.Force {
+			// RemoveAll is fine with a missing path, only a racing
+			// removal can still surface as not exist
+			err := os.RemoveAll(outputdir)
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return false, fmt.Errorf("trying to remove existing output dir: %w", err)
+			}
+		} else {
+			info, err := os.Lstat(outputdir)
+			if err == nil && info.IsDir() && c.Merge {
+				continue
+			}
+			if err == nil && info.Mode()&os.ModeSymlink != 0 && c.Mode == InstallSymlink {
+				// fine if it already links to the entry, known
+				// once it is looked up
+				linked = append(linked, i)
+			} else if !os.IsNotExist(err) {
+				return false, outputExists(outputdir)
+			}
+		}
+	}
+
+	var depDir string
+	var cached bool
+	var lock *Lock
+	opts := c.InstallOptions
+	if c.ReadOnly {
+		var tmpStore string
+		depDir, cached, tmpStore, err = c.findReadOnly(keys, k)
+		if tmpStore != "" {
+			defer os.RemoveAll(tmpStore)
+			if opts.Mode == InstallSymlink {
+				// the link would dangle once tmpStore is gone
+				opts.Mode = InstallHardlink
+			}
+		}
+		// extracting would write to the store
+		opts.ExtractCacheSize = 0
+	} else {
+		depDir, cached, lock, err = c.find(keys, k)
+	}
+	if err != nil {
+		return false, err
+	}
+	if lock != nil {
+		defer lock.Unlock()
+	}
+
+	var replaced []int
+	for _, i := range linked {
+		target := installSource(depDir, opts)
+		if len(outputs) > 1 {
+			target = outputDir(target, i)
+		}
+		target = filepath.Join(target, filepath.FromSlash(opts.Subpath))
+		if cached && LinksTo(outputs[i], target) {
+			continue
+		}
+		if !c.Idempotent || !linksIntoStore(outputs[i], c.NamespaceDir()) {
+			return false, outputExists(outputs[i])
+		}
+		if cached {
+			replaced = append(replaced, i)
+			continue
+		}
+		// the command generates the output afresh
+		Progressf("Output %s links to another cache entry - removing it", outputs[i])
+		err := os.Remove(outputs[i])
+		if err != nil {
+			return false, fmt.Errorf("removing stale output link: %w", err)
+		}
+	}
+
+	lookup := time.Since(lookupStart)
+	if !cached {
+		c.emit(&MissEvent{Key: filepath.Base(depDir), Entry: depDir, Outputs: outputs, Lookup: lookup})
+	}
+	if !cached && c.FailOnMiss {
+		LogEvent(Event{Event: "miss", Key: filepath.Base(depDir)})
+		return false, fmt.Errorf("%s is %w and misses are refused", filepath.Base(depDir), ErrNotCached)
+	}
+	if !cached && len(cmd) == 0 {
+		return false, fmt.Errorf("%s is %w and there is no command to generate it", filepath.Base(depDir), ErrNotCached)
+	}
+	if !cached && !c.SkipCommandCheck {
+		err := checkCommand(cmd[0], c.RunDir)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	// build
+	start := time.Now()
+	key := filepath.Base(depDir)
+	exitCode := 0
+	if cached {
+		LogEvent(Event{Event: "hit", Key: key})
+		Progress("Found cached dependencies - installing those")
+		checkManifest(depDir, cmd)
+		done := Step("install")
+		err = installReplacing(depDir, outputs, replaced, opts)
+		done()
+		if err == nil {
+			err = runHook("post-install", c.PostInstall)
+		}
+		if err == nil {
+			c.emit(&HitEvent{Key: key, Entry: depDir, Outputs: outputs, Lookup: lookup, Install: time.Since(start)})
+		}
+	} else {
+		exitCode, err = c.miss(depDir, k, outputs, cmd)
+	}
+	if err == nil && !c.ReadOnly {
+		err = Touch(depDir)
+	}
+
+	elapsed := time.Now().Sub(start)
+	doneEv := Event{Event: "done", Key: key, DurationMS: Millis(elapsed)}
+	Log.printTimings(Log.TakeTimings(), &doneEv)
+	if err != nil {
+		doneEv.Error = err.Error()
+		LogEvent(doneEv)
+		return cached, err
+	}
+
+	LogEvent(doneEv)
+	Progressf("Succeeded in %.2f sec", elapsed.Seconds())
+
+	if !c.ReadOnly {
+		err = RecordRun(c.NamespaceDir(), Run{Time: start, Key: key, Hit: cached, DurationMS: elapsed.Milliseconds()})
+		if err != nil {
+			Progress("Couldn't record the run in the stats log: ", err)
+		}
+	}
+	if exitCode != 0 {
+		return cached, &AcceptedExitError{Code: exitCode}
+	}
+	return cached, nil
+}
+
+// AcceptedExitError is returned by EnsureInstalled when the command exited
+// with one of AcceptExitCodes. Its output was cached and installed.
+type AcceptedExitError struct {
+	Code int
+}
+
+func (e *AcceptedExitError) Error() string {
+	return fmt.Sprintf("command exited with %d, its output was cached anyway", e.Code)
+}
+
+// CommandError is returned by EnsureInstalled and Warm when the command
+// generating the outputs failed. Code is its exit code, or 128 plus the
+// signal number if it was killed by one, as shells report it.
+type CommandError struct {
+	Code int
+	Err  error
+}
+
+func (e *CommandError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *CommandError) Unwrap() error {
+	return e.Err
+}
+
+// commandError wraps err in a CommandError if it is an exit of the command.
+func commandError(err error) error {
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return err
+	}
+	code := exitErr.ExitCode()
+	if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		code = 128 + int(ws.Signal())
+	}
+	return &CommandError{Code: code, Err: err}
+}
+
+// linksIntoStore reports whether out is a symlink into an entry of store.
+func linksIntoStore(out, store string) bool {
+	store, err := resolvePath(store)
+	if err != nil {
+		return false
+	}
+	_, ok := linkedKey(out, store)
+	return ok
+}
+
+// installReplacing is InstallEntry, only the outputs[i] for i in replaced
+// are installed next to the existing ones and then renamed over them.
+func installReplacing(dir string, outputs []string, replaced []int, opts InstallOptions) error {
+	if len(replaced) == 0 {
+		return InstallEntry(dir, outputs, opts)
+	}
+	dests := append([]string(nil), outputs...)
+	for _, i := range replaced {
+		dests[i] = tmpDir(outputs[i])
+		os.RemoveAll(dests[i])
+	}
+	err := InstallEntry(dir, dests, opts)
+	for _, i := range replaced {
+		if err == nil {
+			Progressf("Output %s linked to another cache entry - relinking", outputs[i])
+			err = os.Rename(dests[i], outputs[i])
+		}
+		if err != nil {
+			os.RemoveAll(dests[i])
+		}
+	}
+	return err
+}
+
+// find looks up the entry for keys, fetching it from the remote if it
+// isn't in the store. Entries failing Verify are removed. On a miss the
+// entry, keyed off k, is returned locked.
+func (c *Cache) find(keys []string, k KeySpec) (depDir string, cached bool, lock *Lock, err error) {
+	depDir, cached, err = c.lookup(keys)
+	if err != nil {
+		return "", false, nil, fmt.Errorf("looking up cache dir: %w", err)
+	}
+
+	if cached && c.Verify {
+		ok, err := Verify(depDir)
+		if err != nil {
+			return "", false, nil, fmt.Errorf("verifying cache entry: %w", err)
+		}
+		if !ok {
+			Progress("Cached dependencies are corrupt - regenerating")
+			_, err := removeUnlocked(Entry{Dir: depDir})
+			if err != nil {
+				return "", false, nil, fmt.Errorf("removing corrupt cache entry: %w", err)
+			}
+			depDir, cached = filepath.Join(c.NamespaceDir(), keys[0]), false
+		}
+	}
+	if cached {
+		return depDir, true, nil, nil
+	}
+
+	done := Step("lock acquisition")
+	lock, err = LockEntry(depDir, c.LockTimeout)
+	if err != nil {
+		return "", false, nil, fmt.Errorf("locking cache entry: %w", err)
+	}
+	done()
+
+	// it might have been generated while we waited for the lock
+	depDir, cached, err = c.lookup(keys)
+	if err != nil {
+		lock.Unlock()
+		return "", false, nil, fmt.Errorf("looking up cache dir: %w", err)
+	}
+
+	if !cached && c.Remote != nil {
+		done := Step("remote fetch")
+		cached = c.pull(depDir, k)
+		done()
+	}
+	return depDir, cached, lock, nil
+}
+
+// checkCommand fails if bin can't be run in dir, rather than having that
+// show up as an exec error once the entry is being generated.
+func checkCommand(bin, dir string) error {
+	p := bin
+	if dir != "" && !filepath.IsAbs(bin) && strings.ContainsRune(bin, filepath.Separator) {
+		// relative to where it runs
+		p = filepath.Join(dir, bin)
+	}
+	_, err := exec.LookPath(p)
+	if errors.Is(err, exec.ErrNotFound) {
+		return fmt.Errorf("command %s not found in PATH", bin)
+	}
+	if err != nil {
+		return fmt.Errorf("can't run command %s: %w", bin, err)
+	}
+	return nil
+}
+
+// ErrNotCached is wrapped by the error of EnsureInstalled for misses it
+// can't or mustn't generate the entry for, see Cache.FailOnMiss.
+var ErrNotCached = errors.New("not cached")
+
+// ErrOutputExists is wrapped by the error of EnsureInstalled when an output
+// is in the way, see Cache.Force.
+var ErrOutputExists = errors.New("already exists")
+
+func outputExists(outputdir string) error {
+	return fmt.Errorf("output path '%s' %w - maybe rerun with `-f`", outputdir, ErrOutputExists)
+}
+
+// lookup returns the cache dir of the first of keys present in the store.
+// If none are, the dir for the first key is returned.
+func (c *Cache) lookup(keys []string) (dir string, cached bool, err error) {
+	for i, k := range keys {
+		dir := filepath.Join(c.NamespaceDir(), k)
+		cached, err := EntryExists(dir)
+		if err != nil {
+			return "", false, err
+		}
+		if !cached {
+			continue
+		}
+		if i > 0 {
+			Progressf("Using legacy %s cache entry %s", legacyAlgo, k)
+		}
+		return dir, true, nil
+	}
+	return filepath.Join(c.NamespaceDir(), keys[0]), false, nil
+}
+
+// miss generates the entry dir for k, pushes it to the remote and evicts
+// entries if the store has grown too large. Outputs which didn't exist
+// before are removed again if generating the entry fails.
+func (c *Cache) miss(dir string, k KeySpec, outputs, cmd []string) (exitCode int, err error) {
+	key := filepath.Base(dir)
+	LogEvent(Event{Event: "miss", Key: key})
+	err = runHook("pre-generate", c.PreGenerate)
+	if err != nil {
+		return 0, err
+	}
+	LogEvent(Event{Event: "generate", Key: key, Message: strings.Join(cmd, " ")})
+	if c.ReadOnly {
+		Progressf("Running `%s` - the cache is read-only, so its output won't be cached", strings.Join(cmd, " "))
+	} else {
+		Progressf("Running `%s` and caching the output", strings.Join(cmd, " "))
+	}
+	if d, ok := lastBuild(c.NamespaceDir(), outputs); ok {
+		Progressf("Previous build took %v", d.Round(100*time.Millisecond))
+	}
+	var created []string
+	for _, out := range outputs {
+		if _, err := os.Lstat(out); os.IsNotExist(err) {
+			created = append(created, out)
+		}
+	}
+	m := keyManifest(k, c.Hash)
+	c.emit(&GenerateStartEvent{Key: key, Outputs: outputs, Cmd: cmd})
+	start := time.Now()
+	exitCode, err = c.generate(dir, outputs, m, cmd)
+	if err == nil && c.Subpath != "" {
+		for _, out := range outputs {
+			err = TrimOutput(out, c.Subpath)
+			if err != nil {
+				break
+			}
+		}
+	}
+	c.emit(&GenerateDoneEvent{Key: key, Entry: dir, Outputs: outputs, Cmd: cmd, Duration: time.Since(start), ExitCode: exitCode, Err: err})
+	if err != nil {
+		// a rerun would take what the failed run left behind for an
+		// existing output, merged outputs are kept though
+		for _, out := range created {
+			os.RemoveAll(out)
+		}
+		return exitCode, err
+	}
+	if c.ReadOnly {
+		return exitCode, nil
+	}
+	if c.Remote != nil && putsAny(c.Remote) {
+		c.push(dir)
+	}
+	if c.MaxSize > 0 {
+		err = Evict(c.NamespaceDir(), c.MaxSize)
+	}
+	return exitCode, err
+}
+
+// retryBackoff is the wait before the first retry of a failed command, it
+// doubles with every further one.
+const retryBackoff = time.Second
+
+// Environment variables telling the generation command the key of the
+// entry it generates and the store it goes into.
+const (
+	KeyEnv = "CACHE_PKGS_KEY"
+	DirEnv = "CACHE_PKGS_DIR"
+)
+
+// generate runs cmd and caches the resulting outputs in the entry dir,
+// recording the command and creation time in m. It returns the exit code of
+// cmd if it is one of AcceptExitCodes.
+func (c *Cache) generate(dir string, outputs []string, m *Manifest, cmd []string) (exitCode int, err error) {
+	done := Step("command")
+	start := time.Now()
+	env := []string{KeyEnv + "=" + filepath.Base(dir), DirEnv + "=" + filepath.Dir(dir)}
+	attempt := 1
+	for ; ; attempt++ {
+		err = run(c.RunDir, c.Timeout, env, cmd[0], cmd[1:]...)
+		var exitErr *exec.ExitError
+		if err == nil || attempt > c.Retries || errors.Is(err, ErrInterrupted) ||
+			errors.As(err, &exitErr) && c.accepts(exitErr.ExitCode()) {
+			break
+		}
+		wait := retryBackoff << (attempt - 1)
+		Progressf("Command failed (%v) - retrying in %v", err, wait)
+		if !c.Merge {
+			// merged outputs held more than the command's output
+			for _, out := range outputs {
+				os.RemoveAll(out)
+			}
+		}
+		time.Sleep(wait)
+		start = time.Now()
+	}
+	m.BuildMS = time.Since(start).Milliseconds()
+	if errors.Is(err, ErrTimeout) || errors.Is(err, ErrInterrupted) {
+		// don't leave a half built output for the next run to trip over
+		for _, out := range outputs {
+			os.RemoveAll(out)
+		}
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && c.accepts(exitErr.ExitCode()) {
+		exitCode, err = exitErr.ExitCode(), nil
+		Progressf("Command exited with %d - caching its output anyway", exitCode)
+	}
+	if err != nil && attempt > 1 {
+		return 0, commandError(fmt.Errorf("%w (after %d attempts)", err, attempt))
+	}
+	if err != nil {
+		return 0, commandError(err)
+	}
+	done()
+	if c.ReadOnly {
+		return exitCode, nil
+	}
+
+	m.Cmd = cmd
+	return exitCode, c.store(dir, outputs, m)
+}
+
+func (c *Cache) accepts(exitCode int) bool {
+	for _, code := range c.AcceptExitCodes {
+		if code == exitCode {
+			return true
+		}
+	}
+	return false
+}
+
+// store copies outputs into the entry dir, leaving out the paths excluded
+// by m.Exclude and their ignoreFile. They are copied to a temporary dir
+// first and only moved into place once complete, so an interrupted run
+// never leaves a partial entry.
+func (c *Cache) store(dir string, outputs []string, m *Manifest) error {
+	done := Step("copy into cache")
+	defer done()
+	excludes := make([][]string, len(outputs))
+	for i, out := range outputs {
+		var err error
+		excludes[i], err = outputExcludes(out, m.Exclude)
+		if err != nil {
+			return err
+		}
+	}
+
+	tmp := tmpDir(dir)
+	commit := CommitDir
+	var err error
+	switch {
+	case c.Archive:
+		tmp += archiveExt
+		commit = CommitArchive
+		err = writeArchiveFile(tmp, c.Compression, excludes, outputs...)
+	case c.CAS:
+		tmp += casExt
+		commit = commitCAS
+		err = writeCAS(tmp, c.NamespaceDir(), outputs, excludes)
+	case len(outputs) == 1:
+		err = copyExcluding(outputs[0], tmp, c.PreserveOwner, excludes[0])
+	default:
+		err = c.copyOutputs(outputs, tmp, excludes)
+	}
+	if err != nil {
+		return err
+	}
+
+	m.Outputs = absPaths(outputs)
+	m.Created = time.Now()
+	if c.Verify {
+		if !c.Archive && !c.CAS {
+			// the digest covers the mode of the root, which CommitDir
+			// sets
+			err = os.Chmod(tmp, DirMode)
+			if err != nil {
+				os.RemoveAll(tmp)
+				return err
+			}
+		}
+		m.Digest, err = hashFile(tmp, hashAlgos[m.Hash])
+		if err != nil {
+			os.RemoveAll(tmp)
+			return err
+		}
+	}
+	err = WriteManifest(dir, m)
+	if err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+	return commit(tmp, dir)
+}
+
+// copyOutputs copies each of outputs into its subdir of the new entry dir,
+// leaving out the paths of outputs[i] matching excludes[i].
+func (c *Cache) copyOutputs(outputs []string, dir string, excludes [][]string) error {
+	err := os.Mkdir(dir, 0700)
+	if err != nil {
+		return err
+	}
+	for i, out := range outputs {
+		err := copyExcluding(out, outputDir(dir, i), c.PreserveOwner, excludes[i])
+		if err != nil {
+			os.RemoveAll(dir)
+			return err
+		}
+	}
+	return nil
+}
+
+// pull fetches the cache entry dir, keyed off k, from the remote.
+// Failures are reported but otherwise ignored, the entry can still be
+// generated locally.
+func (c *Cache) pull(dir string, k KeySpec) bool {
+	r := c.Remote
+	if c.ReadOnly {
+		r = readOnlyRemote(r)
+	}
+	err := Pull(r, c.remoteKey(dir), dir, c.Archive)
+	if errors.Is(err, ErrCacheMiss) {
+		Progressf("Not found in %s", r)
+		return false
+	}
+	if err != nil {
+		Progressf("Can't fetch from %s, generating locally: %v", r, err)
+		return false
+	}
+
+	m := keyManifest(k, c.Hash)
+	m.Source = r.String()
+	m.Created = time.Now()
+	err = WriteManifest(dir, m)
+	if err != nil {
+		Progress("Can't write manifest: ", err)
+	}
+	Progressf("Fetched cached dependencies from %s", r)
+	return true
+}
+
+// push uploads the cache entry dir to the remote, in the background with
+// AsyncPush. Failures are reported but don't fail the build.
+func (c *Cache) push(dir string) {
+	if c.AsyncPush {
+		c.pushes.Add(1)
+		go func() {
+			defer c.pushes.Done()
+			c.pushNow(dir)
+		}()
+		return
+	}
+	c.pushNow(dir)
+}
+
+// WaitPushes waits for the pushes started with AsyncPush to finish, for
+// up to timeout if positive. It reports whether they did.
+func (c *Cache) WaitPushes(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		c.pushes.Wait()
+		close(done)
+	}()
+	if timeout <= 0 {
+		<-done
+		return true
+	}
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// pushNow sends the cache entry dir to the remote.
+func (c *Cache) pushNow(dir string) {
+	r := c.Remote
+	err := Push(r, c.remoteKey(dir), dir, c.Compression)
+	if err != nil {
+		Progressf("Can't push to %s: %v", r, err)
+		return
+	}
+	Progressf("Pushed cached dependencies to %s", r)
+}
+
+// checkManifest warns if the cache entry dir was generated by another
+// command than cmd.
+func checkManifest(dir string, cmd []string) {
+	m, err := ReadManifest(dir)
+	if err != nil {
+		Progress("Can't read manifest: ", err)
+		return
+	}
+	if m != nil && len(m.Cmd) > 0 && strings.Join(m.Cmd, " ") != strings.Join(cmd, " ") {
+		Progressf("Note: the cached entry was generated by `%s`", strings.Join(m.Cmd, " "))
+	}
+}
@@ -0,0 +1,226 @@
+package cache
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// helperFlag makes the test binary act as the command generating outputs,
+// see helperCmd.
+const helperFlag = "-cache-pkgs-helper"
+
+func TestMain(m *testing.M) {
+	if len(os.Args) > 2 && os.Args[1] == helperFlag {
+		os.Exit(runHelper(os.Args[2], os.Args[3:]))
+	}
+	Log = &Logger{W: io.Discard, Format: LogText}
+	os.Exit(m.Run())
+}
+
+// runHelper runs the helper command name:
+//
+//	write <dir> <rel>[:<octal mode>]..  creates the files rel in dir
+//	fail <dir>                          leaves a partial dir and exits 3
+//	read                                reads a line from stdin
+//	run <cmd> [args..]                  runs cmd as generation commands are
+func runHelper(name string, args []string) int {
+	switch name {
+	case "read":
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil || line == "" {
+			fmt.Fprintln(os.Stderr, "reading stdin:", err)
+			return 2
+		}
+		return 0
+	case "run":
+		err := run("", 0, nil, args[0], args[1:]...)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		return 0
+	case "write":
+		for _, f := range args[1:] {
+			rel, mode := f, os.FileMode(0644)
+			if i := strings.LastIndex(f, ":"); i >= 0 {
+				m, err := strconv.ParseUint(f[i+1:], 8, 32)
+				if err != nil {
+					fmt.Fprintln(os.Stderr, err)
+					return 2
+				}
+				rel, mode = f[:i], unixMode(uint32(m))
+			}
+			err := writeFile(filepath.Join(args[0], filepath.FromSlash(rel)), rel, mode)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return 2
+			}
+		}
+		return 0
+	case "fail":
+		writeFile(filepath.Join(args[0], "partial"), "partial", 0644)
+		return 3
+	}
+	fmt.Fprintln(os.Stderr, "unknown helper command", name)
+	return 2
+}
+
+// unixMode converts the unix mode m, e.g. 04755, to an os.FileMode.
+func unixMode(m uint32) os.FileMode {
+	mode := os.FileMode(m & 0777)
+	if m&04000 != 0 {
+		mode |= os.ModeSetuid
+	}
+	if m&02000 != 0 {
+		mode |= os.ModeSetgid
+	}
+	return mode
+}
+
+// writeFile writes content to p, creating its parent dirs, and gives it
+// mode regardless of the umask. Modes above the permission bits are those
+// of os.FileMode, e.g. os.ModeSetuid.
+func writeFile(p, content string, mode os.FileMode) error {
+	err := os.MkdirAll(filepath.Dir(p), 0755)
+	if err == nil {
+		err = os.WriteFile(p, []byte(content), 0600)
+	}
+	if err == nil {
+		err = os.Chmod(p, mode)
+	}
+	return err
+}
+
+// helperCmd returns the command running the helper command args.
+func helperCmd(t testing.TB, args ...string) []string {
+	t.Helper()
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return append([]string{exe, helperFlag}, args...)
+}
+
+// testCache returns a cache in a store of its own, installing by mode,
+// and a spec file in a dir for the outputs.
+func testCache(t testing.TB, mode InstallMode) (c *Cache, spec, dir string) {
+	t.Helper()
+	root := t.TempDir()
+	c, err := New(filepath.Join(root, "store"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Mode = mode
+	dir = filepath.Join(root, "work")
+	spec = filepath.Join(dir, "spec")
+	err = writeFile(spec, "deps", 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, spec, dir
+}
+
+// ensure runs EnsureInstalled for the single output out, failing t on
+// errors, and returns whether it was a hit.
+func ensure(t testing.TB, c *Cache, spec, out string, cmd []string) bool {
+	t.Helper()
+	hit, err := c.EnsureInstalled(KeySpec{Files: []string{spec}}, []string{out}, cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hit
+}
+
+func TestStoreDir(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("USERPROFILE", home)
+	for _, tc := range []struct {
+		name, dirName, env, want string
+	}{
+		{"explicit", "/explicit", "/env", "/explicit"},
+		{"env", "", "/env", "/env"},
+		{"default", "", "", filepath.Join(home, ".dep-cache")},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv("CACHE_DIR", tc.env)
+			got, err := StoreDir(tc.dirName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.want {
+				t.Errorf("StoreDir(%q) with CACHE_DIR=%q = %q, want %q", tc.dirName, tc.env, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestForceReportsRemovalFailure(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("a path below a file doesn't exist on Windows")
+	}
+	c, spec, dir := testCache(t, InstallSymlink)
+	c.Force = true
+	// nothing can be removed below a file, not even by root
+	file := filepath.Join(dir, "file")
+	err := writeFile(file, "x", 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(file, "out")
+	_, err = c.EnsureInstalled(KeySpec{Files: []string{spec}}, []string{out}, helperCmd(t, "write", out, "f"))
+	if err == nil || !strings.Contains(err.Error(), "trying to remove existing output dir") {
+		t.Fatalf("got %v, want the removal to fail", err)
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		t.Errorf("%v is taken for a missing output", err)
+	}
+}
+
+func TestInstallCreatesParentDirs(t *testing.T) {
+	for _, mode := range []InstallMode{InstallSymlink, InstallCopy, InstallHardlink} {
+		t.Run(mode.String(), func(t *testing.T) {
+			c, spec, dir := testCache(t, mode)
+			out := filepath.Join(dir, "out")
+			ensure(t, c, spec, out, helperCmd(t, "write", out, "f"))
+
+			deep := filepath.Join(dir, "build", "deps", "node_modules")
+			if !ensure(t, c, spec, deep, helperCmd(t, "write", deep, "f")) {
+				t.Fatal("installing to a new path missed")
+			}
+			b, err := os.ReadFile(filepath.Join(deep, "f"))
+			if err != nil || string(b) != "f" {
+				t.Errorf("installed f holds %q, %v", b, err)
+			}
+		})
+	}
+}
+
+func TestFailedGenerateLeavesNoOutput(t *testing.T) {
+	c, spec, dir := testCache(t, InstallSymlink)
+	out := filepath.Join(dir, "out")
+	_, err := c.EnsureInstalled(KeySpec{Files: []string{spec}}, []string{out}, helperCmd(t, "fail", out))
+	var cmdErr *CommandError
+	if !errors.As(err, &cmdErr) || cmdErr.Code != 3 {
+		t.Fatalf("got %v, want the command's exit code 3", err)
+	}
+	if _, err := os.Lstat(out); !os.IsNotExist(err) {
+		t.Fatalf("the failed run left %s behind", out)
+	}
+
+	// without -f the rerun mustn't trip over anything
+	if ensure(t, c, spec, out, helperCmd(t, "write", out, "f")) {
+		t.Fatal("the rerun hit an entry of the failed run")
+	}
+	if _, err := os.Stat(filepath.Join(out, "partial")); !os.IsNotExist(err) {
+		t.Error("the rerun's output holds what the failed run left")
+	}
+}
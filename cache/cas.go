@@ -0,0 +1,345 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// With content addressing (Cache.CAS) every file is kept once in the blobs
+// dir of the store, named by the hash of its contents and its permissions.
+// An entry is then just an index of its tree, <dir>.cas, which is
+// materialized on install by hardlinking the blobs. Installed files share
+// the blob's inode and so also its permissions and modification time.
+const (
+	casExt   = ".cas"
+	blobsDir = "blobs"
+	// blobGrace protects recently added blobs from PruneBlobs, as the
+	// index referencing them may not have been committed yet.
+	blobGrace = time.Hour
+)
+
+func casPath(dir string) string {
+	return dir + casExt
+}
+
+func blobPath(cacheStore, blob string) string {
+	return filepath.Join(cacheStore, blobsDir, blob[:2], blob)
+}
+
+// casIndex lists the tree of a content addressed entry in walk order, so
+// directories come before their contents.
+type casIndex struct {
+	Files []casFile `json:"files"`
+}
+
+type casFile struct {
+	// Path is slash separated and relative to the entry.
+	Path string      `json:"path"`
+	Mode os.FileMode `json:"mode"`
+	// ModTime is only recorded for directories, files have the time of
+	// their blob.
+	ModTime *time.Time `json:"modTime,omitempty"`
+	Blob    string     `json:"blob,omitempty"`
+	Link    string     `json:"link,omitempty"`
+}
+
+func readCAS(p string) (*casIndex, error) {
+	b, err := os.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	idx := &casIndex{}
+	err = json.Unmarshal(b, idx)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", p, err)
+	}
+	return idx, nil
+}
+
+// writeCAS adds the files of outputs to the blobs of cacheStore and writes
+// the index of them to p, leaving out paths of outputs[i] matching
+// excludes[i]. Several outputs are indexed as numbered subdirs like
+// copyOutputs lays them out.
+func writeCAS(p, cacheStore string, outputs []string, excludes [][]string) error {
+	idx := casIndex{}
+	if len(outputs) > 1 {
+		now := time.Now()
+		idx.Files = append(idx.Files, casFile{Path: ".", Mode: os.ModeDir | 0755, ModTime: &now})
+	}
+	for i, out := range outputs {
+		prefix := ""
+		if len(outputs) > 1 {
+			prefix = strconv.Itoa(i)
+		}
+		err := filepath.Walk(out, func(src string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(out, src)
+			if err != nil {
+				return err
+			}
+			if rel != "." && excluded(filepath.ToSlash(rel), info.IsDir(), excludeOf(excludes, i)) {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			f := casFile{Path: filepath.ToSlash(filepath.Join(prefix, rel)), Mode: info.Mode()}
+			switch mode := info.Mode(); {
+			case mode.IsDir():
+				t := info.ModTime()
+				f.ModTime = &t
+			case mode&os.ModeSymlink != 0:
+				f.Link, err = os.Readlink(src)
+			case mode.IsRegular():
+				f.Blob, err = addBlob(cacheStore, src, info)
+			default:
+				// sockets, devices and the like have no business in a cache
+				return nil
+			}
+			if err != nil {
+				return &CopyError{Path: src, Err: err}
+			}
+			idx.Files = append(idx.Files, f)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	b, err := json.Marshal(idx)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(p, b, 0644)
+}
+
+// addBlob copies the file src into the blobs of cacheStore unless they
+// have it already and returns its blob name.
+func addBlob(cacheStore, src string, info os.FileInfo) (string, error) {
+	sum, err := hashFile(src, sha256.New)
+	if err != nil {
+		return "", err
+	}
+	blob := fmt.Sprintf("%s-%04o", sum, info.Mode().Perm())
+	p := blobPath(cacheStore, blob)
+
+	now := time.Now()
+	if err := os.Chtimes(p, now, now); err == nil {
+		return blob, nil
+	}
+	err = mkdirStore(filepath.Dir(p))
+	if err != nil {
+		return "", err
+	}
+	tmp := tmpDir(p)
+	err = copyFile(src, tmp, info, false)
+	if err == nil {
+		err = os.Chtimes(tmp, now, now)
+	}
+	if err == nil {
+		err = os.Rename(tmp, p)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		if _, errStat := os.Stat(p); errStat == nil {
+			// added by someone else meanwhile
+			return blob, nil
+		}
+		return "", err
+	}
+	return blob, nil
+}
+
+// commitCAS atomically moves the index tmp into place as the index of the
+// cache entry dir.
+func commitCAS(tmp, dir string) error {
+	err := os.Rename(tmp, casPath(dir))
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// materializeCAS recreates the tree indexed by the cache entry dir below
+// prefix at to, hardlinking the files unless link is false. An empty
+// prefix is the whole entry.
+func materializeCAS(dir, prefix, to string, link bool) error {
+	idx, err := readCAS(casPath(dir))
+	if err != nil {
+		return err
+	}
+	cacheStore := filepath.Dir(dir)
+
+	var dirs []casFile
+	copying := !link
+	found := false
+	folds := newCaseFolds()
+	for _, f := range idx.Files {
+		rel, ok := casRel(f.Path, prefix)
+		if !ok {
+			continue
+		}
+		found = true
+		target := filepath.Join(to, filepath.FromSlash(rel))
+		err = folds.check(rel, target)
+		if err != nil {
+			return err
+		}
+		switch {
+		case f.Mode.IsDir():
+			err = os.Mkdir(target, 0700)
+			f.Path = target
+			dirs = append(dirs, f)
+		case f.Mode&os.ModeSymlink != 0:
+			err = os.Symlink(f.Link, target)
+		default:
+			blob := blobPath(cacheStore, f.Blob)
+			if !copying {
+				err = os.Link(blob, target)
+				if isCrossDevice(err) {
+					Progress("Cache and output are on different filesystems - copying instead of hardlinking")
+					copying = true
+				}
+			}
+			if copying {
+				var info os.FileInfo
+				info, err = os.Stat(blob)
+				if err == nil {
+					err = copyFile(blob, target, info, false)
+				}
+			}
+		}
+		if err != nil {
+			return &CopyError{Path: target, Err: err}
+		}
+	}
+
+	if !found {
+		return fmt.Errorf("cache entry has no directory %s", prefix)
+	}
+
+	// innermost first, as filling a dir touches its modification time
+	for i := len(dirs) - 1; i >= 0; i-- {
+		d := dirs[i]
+		err := os.Chmod(d.Path, d.Mode.Perm())
+		if err == nil {
+			err = os.Chtimes(d.Path, *d.ModTime, *d.ModTime)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeEntryArchive archives the tree of the unpacked or content addressed
+// cache entry dir to p.
+func writeEntryArchive(p, compression, dir string) error {
+	if _, err := os.Stat(casPath(dir)); err != nil {
+		return writeArchiveFile(p, compression, nil, dir)
+	}
+	tree := tmpDir(dir)
+	defer os.RemoveAll(tree)
+	err := materializeCAS(dir, "", tree, true)
+	if err != nil {
+		return err
+	}
+	return writeArchiveFile(p, compression, nil, tree)
+}
+
+// casRel returns p relative to prefix, if it is below it.
+func casRel(p, prefix string) (string, bool) {
+	switch {
+	case prefix == "":
+		return p, true
+	case p == prefix:
+		return ".", true
+	case strings.HasPrefix(p, prefix+"/"):
+		return p[len(prefix)+1:], true
+	}
+	return "", false
+}
+
+// casSize returns the size of the blobs the index of the cache entry dir
+// references. Blobs shared between entries count for each of them.
+func casSize(dir string) (int64, error) {
+	idx, err := readCAS(casPath(dir))
+	if err != nil {
+		return 0, err
+	}
+	var size int64
+	for _, f := range idx.Files {
+		if f.Blob == "" {
+			continue
+		}
+		info, err := os.Stat(blobPath(filepath.Dir(dir), f.Blob))
+		if err != nil {
+			return 0, err
+		}
+		size += info.Size()
+	}
+	return size, nil
+}
+
+// PruneBlobs removes the blobs in cacheStore no entry references any more.
+// Blobs added within blobGrace are kept.
+func PruneBlobs(cacheStore string) error {
+	n, freed, err := pruneBlobs(cacheStore, false)
+	if n > 0 {
+		Progressf("Removed %d unreferenced blobs (%s)", n, FormatSize(freed))
+	}
+	return err
+}
+
+// pruneBlobs is PruneBlobs, only counting the blobs with dryRun.
+func pruneBlobs(cacheStore string, dryRun bool) (n int, freed int64, err error) {
+	if ok, err := IsDir(filepath.Join(cacheStore, blobsDir)); !ok || err != nil {
+		return 0, 0, err
+	}
+
+	used := map[string]bool{}
+	indexes, err := filepath.Glob(filepath.Join(cacheStore, "*"+casExt))
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, p := range indexes {
+		if strings.Contains(filepath.Base(p), tmpMarker) {
+			continue
+		}
+		idx, err := readCAS(p)
+		if err != nil {
+			return 0, 0, err
+		}
+		for _, f := range idx.Files {
+			used[f.Blob] = true
+		}
+	}
+
+	cutoff := time.Now().Add(-blobGrace)
+	err = filepath.Walk(filepath.Join(cacheStore, blobsDir), func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		if used[info.Name()] || info.ModTime().After(cutoff) {
+			return nil
+		}
+		if !dryRun {
+			err = os.Remove(p)
+		}
+		if err == nil {
+			n++
+			freed += info.Size()
+		}
+		return err
+	})
+	return n, freed, err
+}
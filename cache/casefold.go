@@ -0,0 +1,73 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrCaseCollision is wrapped by the error of writing a tree with paths
+// differing only in case, e.g. Makefile and makefile, to a case-insensitive
+// filesystem such as the macOS and Windows defaults. The second path would
+// otherwise silently replace or merge into the first.
+var ErrCaseCollision = errors.New("differ only in case")
+
+// caseFolds tracks the paths written to a tree by their lower case, to
+// catch collisions before they clobber anything. Trees from the same
+// filesystem can't have any, only entries made elsewhere, e.g. on Linux
+// and fetched from a Remote.
+type caseFolds struct {
+	seen map[string]string
+	// insensitive caches whether the filesystem folds case, once a
+	// candidate collision made it worth probing.
+	insensitive *bool
+}
+
+func newCaseFolds() *caseFolds {
+	return &caseFolds{seen: map[string]string{}}
+}
+
+// check fails if the slash separated rel differs from a path checked
+// before only in case and target, where rel is written, is on a
+// case-insensitive filesystem.
+func (f *caseFolds) check(rel, target string) error {
+	folded := strings.ToLower(rel)
+	prev, ok := f.seen[folded]
+	if !ok {
+		f.seen[folded] = rel
+		return nil
+	}
+	if prev == rel {
+		return nil
+	}
+	if f.insensitive == nil {
+		insensitive, err := caseInsensitive(filepath.Dir(target))
+		if err != nil {
+			return err
+		}
+		f.insensitive = &insensitive
+	}
+	if !*f.insensitive {
+		return nil
+	}
+	return fmt.Errorf("%s and %s %w, which the case-insensitive filesystem of %s can't tell apart", prev, rel, ErrCaseCollision, filepath.Dir(target))
+}
+
+// caseInsensitive reports whether the filesystem of the existing dir
+// ignores the case of names, by creating a file and looking it up in
+// another case.
+func caseInsensitive(dir string) (bool, error) {
+	f, err := os.CreateTemp(dir, ".Case-Probe-*")
+	if err != nil {
+		return false, err
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	_, err = os.Lstat(filepath.Join(dir, strings.ToLower(filepath.Base(f.Name()))))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
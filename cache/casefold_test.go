@@ -0,0 +1,138 @@
+package cache
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestCaseFoldsCheck(t *testing.T) {
+	target := filepath.Join(t.TempDir(), "out")
+	for _, insensitive := range []bool{false, true} {
+		f := newCaseFolds()
+		f.insensitive = &insensitive
+		for _, rel := range []string{"Makefile", "src/a.go", "Makefile"} {
+			if err := f.check(rel, target); err != nil {
+				t.Fatalf("%s: %v", rel, err)
+			}
+		}
+		err := f.check("makefile", target)
+		if insensitive && !errors.Is(err, ErrCaseCollision) {
+			t.Errorf("case-insensitive: got %v, want ErrCaseCollision", err)
+		}
+		if insensitive && err != nil && !strings.Contains(err.Error(), "Makefile and makefile") {
+			t.Errorf("%v doesn't name both paths", err)
+		}
+		if !insensitive && err != nil {
+			t.Errorf("case-sensitive: %v", err)
+		}
+	}
+}
+
+func TestCaseInsensitiveProbe(t *testing.T) {
+	dir := t.TempDir()
+	// find out what the filesystem does without the probe
+	err := os.WriteFile(filepath.Join(dir, "Probe"), nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = os.Lstat(filepath.Join(dir, "probe"))
+	want := err == nil
+	os.Remove(filepath.Join(dir, "Probe"))
+
+	got, err := caseInsensitive(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("caseInsensitive = %v, want %v", got, want)
+	}
+	left, _ := os.ReadDir(dir)
+	if len(left) != 0 {
+		t.Errorf("the probe left %d files behind", len(left))
+	}
+}
+
+// TestCopyCaseCollision copies a tree with names differing only in case,
+// which only a case-sensitive filesystem can hold, so it is the source.
+// The copy must hold both, or fail clearly.
+func TestCopyCaseCollision(t *testing.T) {
+	src, dst := filepath.Join(t.TempDir(), "src"), filepath.Join(t.TempDir(), "dst")
+	for _, name := range []string{"Makefile", "makefile"} {
+		err := writeFile(filepath.Join(src, name), name, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if entries, _ := os.ReadDir(src); len(entries) != 2 {
+		t.Skip("the temp dir is on a case-insensitive filesystem")
+	}
+	insensitive, err := caseInsensitive(filepath.Dir(dst))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = Copy(src, dst)
+	if insensitive {
+		if !errors.Is(err, ErrCaseCollision) {
+			t.Fatalf("got %v, want ErrCaseCollision", err)
+		}
+		return
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"Makefile", "makefile"} {
+		b, err := os.ReadFile(filepath.Join(dst, name))
+		if err != nil || string(b) != name {
+			t.Errorf("%s holds %q, %v", name, b, err)
+		}
+	}
+}
+
+func TestCopySymlinks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks need privileges")
+	}
+	src, dst := filepath.Join(t.TempDir(), "src"), filepath.Join(t.TempDir(), "dst")
+	err := writeFile(filepath.Join(src, "lib", "real.js"), "x", 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	links := map[string]string{
+		"rel":      "lib/real.js",
+		"lib/up":   "../lib",
+		"abs":      "/usr/bin/env",
+		"dangling": "missing/file",
+	}
+	for name, target := range links {
+		err := os.Symlink(target, filepath.Join(src, filepath.FromSlash(name)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = Copy(src, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// targets are kept as written, not resolved
+	for name, want := range links {
+		p := filepath.Join(dst, filepath.FromSlash(name))
+		info, err := os.Lstat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			t.Errorf("%s was copied as %v, not a symlink", name, info.Mode())
+			continue
+		}
+		got, err := os.Readlink(p)
+		if err != nil || got != want {
+			t.Errorf("%s links to %q, %v, want %q", name, got, err, want)
+		}
+	}
+}
@@ -0,0 +1,409 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// CopyParallelism is how many files are copied or hardlinked at once when
+// copying a tree.
+var CopyParallelism = runtime.NumCPU()
+
+// CopyError records the path at which a Copy failed.
+type CopyError struct {
+	Path string
+	Err  error
+}
+
+func (e *CopyError) Error() string {
+	return "copy " + e.Path + ": " + e.Err.Error()
+}
+
+func (e *CopyError) Unwrap() error {
+	return e.Err
+}
+
+// Copy recursively copies the tree at a to b, which must not exist yet.
+// File modes and modification times are preserved and symlinks are copied
+// as symlinks. If the copy fails b is removed again. With CopyCmd set that
+// command does the copying.
+//
+// Symlinks keep their target as written and are never followed. Their own
+// modes and times, which macOS and the BSDs have unlike Linux, aren't
+// copied, so copies behave the same everywhere. Paths differing only in
+// case fail with ErrCaseCollision if b is on a case-insensitive
+// filesystem.
+func Copy(a, b string) error {
+	return copyExcluding(a, b, false, nil)
+}
+
+// CopyOwner is Copy, preserving the owners of what it copies as well. That
+// needs root.
+func CopyOwner(a, b string) error {
+	return copyExcluding(a, b, true, nil)
+}
+
+// copyExcluding is Copy, leaving out the paths matching exclude, see
+// excluded. Copies are made with CopyCmd if it is set.
+func copyExcluding(a, b string, preserveOwner bool, exclude []string) error {
+	var err error
+	if len(CopyCmd) > 0 {
+		err = copyWithCmd(a, b, exclude)
+	} else {
+		err = copyTree(a, b, copyOpts{preserveOwner: preserveOwner, exclude: exclude})
+	}
+	if err != nil {
+		errRm := os.RemoveAll(b)
+		if errRm != nil && !os.IsNotExist(errRm) {
+			return errRm
+		}
+	}
+	return err
+}
+
+// Merge copies the tree at a over the dir b, replacing whatever is at the
+// paths in a and leaving everything else in b alone. With link files are
+// hardlinked rather than copied. Unlike Copy b isn't removed on failure.
+func Merge(a, b string, link, preserveOwner bool) error {
+	return copyTree(a, b, copyOpts{link: link, preserveOwner: preserveOwner, merge: true})
+}
+
+type copyOpts struct {
+	// link hardlinks files rather than copying them.
+	link bool
+	// preserveOwner copies owners along with modes and times.
+	preserveOwner bool
+	// merge lets dst exist already, see Merge.
+	merge bool
+	// exclude are patterns of paths not to copy, see excluded.
+	exclude []string
+}
+
+// copyTree copies the tree at src to dst. Dirs and symlinks are created
+// while walking src, so always before what is inside them, and the files
+// are handed to CopyParallelism workers. The first error stops them all,
+// as do paths of src colliding in dst, see ErrCaseCollision.
+// Progress is reported unless Log is Quiet, see copyProgress.
+func copyTree(src, dst string, o copyOpts) error {
+	// Directory modes and times are applied once their contents are
+	// written, deepest first. Otherwise read-only dirs couldn't be filled
+	// and adding entries would bump the mtimes.
+	type dir struct {
+		path string
+		info os.FileInfo
+	}
+	var dirs []dir
+
+	var prog *copyProgress
+	if !Log.Quiet {
+		prog = startCopyProgress(src, o.exclude)
+		defer prog.stop()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+	type file struct {
+		src, dst string
+		info     os.FileInfo
+	}
+	files := make(chan file)
+	folds := newCaseFolds()
+	for i := 0; i < max(CopyParallelism, 1); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for f := range files {
+				if ctx.Err() != nil {
+					continue
+				}
+				var err error
+				if o.link {
+					err = os.Link(f.src, f.dst)
+				} else {
+					err = copyFile(f.src, f.dst, f.info, o.preserveOwner)
+				}
+				if err == nil {
+					prog.add(f.info.Size())
+				}
+				if err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = &CopyError{Path: f.src, Err: err}
+						cancel()
+					}
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+
+	err := filepath.Walk(src, func(p string, info os.FileInfo, err error) error {
+		if ctx.Err() != nil {
+			// a worker failed, its error is returned below
+			return ctx.Err()
+		}
+		if err != nil {
+			return &CopyError{Path: p, Err: err}
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return &CopyError{Path: p, Err: err}
+		}
+		if rel != "." && excluded(filepath.ToSlash(rel), info.IsDir(), o.exclude) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		target := filepath.Join(dst, rel)
+		err = folds.check(filepath.ToSlash(rel), target)
+		if err != nil {
+			return &CopyError{Path: p, Err: err}
+		}
+
+		keepDir := false
+		if o.merge {
+			keepDir, err = clearTarget(target, info)
+			if err != nil {
+				return &CopyError{Path: p, Err: err}
+			}
+		}
+
+		switch mode := info.Mode(); {
+		case keepDir:
+			// metadata applied below like for new dirs, but the
+			// mode must let us fill it meanwhile
+			err = os.Chmod(target, 0700)
+			dirs = append(dirs, dir{target, info})
+		case mode.IsDir():
+			err = os.Mkdir(target, 0700)
+			dirs = append(dirs, dir{target, info})
+		case mode&os.ModeSymlink != 0:
+			err = copySymlink(p, target)
+			if err == nil && o.preserveOwner {
+				err = copyOwner(target, info)
+			}
+		case mode.IsRegular():
+			select {
+			case files <- file{p, target, info}:
+			case <-ctx.Done():
+			}
+		default:
+			// sockets, devices and the like have no business in a cache
+			return nil
+		}
+		if err != nil {
+			return &CopyError{Path: p, Err: err}
+		}
+		return nil
+	})
+	close(files)
+	wg.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
+	if err != nil {
+		return err
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		d := dirs[i]
+		err := copyMetadata(d.path, d.info, o.preserveOwner)
+		if err != nil {
+			return &CopyError{Path: d.path, Err: err}
+		}
+	}
+	return nil
+}
+
+// copyProgressInterval is how often the progress of a copy is reported.
+// Copies done sooner aren't reported at all.
+var copyProgressInterval = 2 * time.Second
+
+// copyProgress counts the files copied by copyTree and reports them every
+// copyProgressInterval. Once the first report is due the tree is walked
+// for its totals, so copies done sooner don't walk it twice. A nil
+// copyProgress counts nothing.
+type copyProgress struct {
+	src                    string
+	exclude                []string
+	files, bytes           atomic.Int64
+	totalFiles, totalBytes atomic.Int64
+	// totalled is set once totalFiles and totalBytes are complete.
+	totalled atomic.Bool
+	stopped  chan struct{}
+	wg       sync.WaitGroup
+}
+
+// startCopyProgress starts reporting the copy of the tree at src.
+func startCopyProgress(src string, exclude []string) *copyProgress {
+	p := &copyProgress{src: src, exclude: exclude, stopped: make(chan struct{})}
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		t := time.NewTicker(copyProgressInterval)
+		defer t.Stop()
+		for ticks := 0; ; ticks++ {
+			select {
+			case <-p.stopped:
+				return
+			case <-t.C:
+				if ticks == 0 {
+					p.wg.Add(1)
+					go p.total()
+				}
+				p.report()
+			}
+		}
+	}()
+	return p
+}
+
+// total totals the files copyTree copies from src, unless the copy is
+// done first.
+func (p *copyProgress) total() {
+	defer p.wg.Done()
+	err := filepath.Walk(p.src, func(path string, info os.FileInfo, err error) error {
+		select {
+		case <-p.stopped:
+			return filepath.SkipAll
+		default:
+		}
+		if err != nil {
+			// the copy runs into it too and reports it
+			return nil
+		}
+		rel, err := filepath.Rel(p.src, path)
+		if err != nil {
+			return nil
+		}
+		if rel != "." && excluded(filepath.ToSlash(rel), info.IsDir(), p.exclude) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.Mode().IsRegular() {
+			p.totalFiles.Add(1)
+			p.totalBytes.Add(info.Size())
+		}
+		return nil
+	})
+	if err == nil {
+		p.totalled.Store(true)
+	}
+}
+
+func (p *copyProgress) add(size int64) {
+	if p == nil {
+		return
+	}
+	p.files.Add(1)
+	p.bytes.Add(size)
+}
+
+func (p *copyProgress) stop() {
+	close(p.stopped)
+	p.wg.Wait()
+}
+
+// report writes the counts as a "progress" event with Format LogJSON and
+// as a line for humans otherwise. Until the tree is totalled the totals
+// are left out.
+func (p *copyProgress) report() {
+	c := &CopyCounts{Files: p.files.Load(), Bytes: p.bytes.Load()}
+	msg := fmt.Sprintf("Copied %d files, %s", c.Files, FormatSize(c.Bytes))
+	if p.totalled.Load() {
+		c.FilesTotal, c.BytesTotal = p.totalFiles.Load(), p.totalBytes.Load()
+		msg = fmt.Sprintf("Copied %d/%d files, %s/%s", c.Files, c.FilesTotal, FormatSize(c.Bytes), FormatSize(c.BytesTotal))
+	}
+	if Log.Format == LogJSON {
+		LogEvent(Event{Event: "progress", Message: msg, Copied: c})
+		return
+	}
+	ProgressPrint(msg)
+}
+
+// clearTarget makes room at target for the entry described by info. An
+// existing dir is kept if info is a dir too, anything else is removed.
+func clearTarget(target string, info os.FileInfo) (keepDir bool, err error) {
+	t, err := os.Lstat(target)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if t.IsDir() && info.IsDir() {
+		return true, nil
+	}
+	return false, os.RemoveAll(target)
+}
+
+func copySymlink(src, dst string) error {
+	target, err := os.Readlink(src)
+	if err != nil {
+		return err
+	}
+	return os.Symlink(target, dst)
+}
+
+func copyFile(src, dst string, info os.FileInfo, preserveOwner bool) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if errClose := out.Close(); err == nil {
+		err = errClose
+	}
+	if err != nil {
+		return err
+	}
+	return copyMetadata(dst, info, preserveOwner)
+}
+
+// isCrossDevice reports whether err stems from linking across filesystems.
+func isCrossDevice(err error) bool {
+	return errors.Is(err, syscall.EXDEV)
+}
+
+// copyMetadata applies the mode, including setuid, setgid and sticky bits,
+// and modification time of info to p. With preserveOwner the owner is
+// copied as well.
+func copyMetadata(p string, info os.FileInfo, preserveOwner bool) error {
+	if preserveOwner {
+		// before chmod, chown clears setuid and setgid
+		err := copyOwner(p, info)
+		if err != nil {
+			return err
+		}
+	}
+
+	mode := info.Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+	err := os.Chmod(p, mode)
+	if err != nil {
+		return err
+	}
+	return os.Chtimes(p, info.ModTime(), info.ModTime())
+}
@@ -0,0 +1,148 @@
+package cache
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// executables are files whose mode bits must survive caching, with the
+// helper write spec creating them.
+var executables = []struct {
+	rel  string
+	mode os.FileMode
+}{
+	{"bin/tool", 0755},
+	{"bin/suid", os.ModeSetuid | 0755},
+	{"lib/data.txt", 0644},
+}
+
+func writeExecutables(t *testing.T, dir string) {
+	t.Helper()
+	for _, f := range executables {
+		err := writeFile(filepath.Join(dir, filepath.FromSlash(f.rel)), f.rel, f.mode)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func checkModes(t *testing.T, dir string) {
+	t.Helper()
+	for _, f := range executables {
+		info, err := os.Stat(filepath.Join(dir, filepath.FromSlash(f.rel)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := info.Mode(); got != f.mode {
+			t.Errorf("%s has mode %v, want %v", f.rel, got, f.mode)
+		}
+	}
+}
+
+func TestCopyKeepsModes(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no unix modes")
+	}
+	src, dst := filepath.Join(t.TempDir(), "src"), filepath.Join(t.TempDir(), "dst")
+	writeExecutables(t, src)
+	err := Copy(src, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkModes(t, dst)
+}
+
+func TestRoundTripKeepsModes(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no unix modes")
+	}
+	for _, format := range []string{FormatDir, FormatArchive, FormatCAS} {
+		t.Run(format, func(t *testing.T) {
+			c, spec, dir := testCache(t, InstallCopy)
+			c.Archive, c.CAS = format == FormatArchive, format == FormatCAS
+			out := filepath.Join(dir, "out")
+			args := []string{"write", out}
+			for _, f := range executables {
+				args = append(args, f.rel+":"+modeString(f.mode))
+			}
+			cmd := helperCmd(t, args...)
+
+			if ensure(t, c, spec, out, cmd) {
+				t.Fatal("first run hit")
+			}
+			checkModes(t, out)
+			err := os.RemoveAll(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !ensure(t, c, spec, out, cmd) {
+				t.Fatal("second run missed")
+			}
+			checkModes(t, out)
+		})
+	}
+}
+
+// modeString formats mode as the unix octal mode the helper parses.
+func modeString(mode os.FileMode) string {
+	m := uint32(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		m |= 04000
+	}
+	if mode&os.ModeSetgid != 0 {
+		m |= 02000
+	}
+	return strconv.FormatUint(uint64(m), 8)
+}
+
+func TestCopyProgressTotals(t *testing.T) {
+	src := t.TempDir()
+	for _, rel := range []string{"a", "sub/b", ".cache/c"} {
+		err := writeFile(filepath.Join(src, rel), "12345", 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	var buf bytes.Buffer
+	defer func(l *Logger) { Log = l }(Log)
+	Log = &Logger{W: &buf, Format: LogText}
+
+	p := &copyProgress{src: src, exclude: []string{".cache/"}, stopped: make(chan struct{})}
+	p.add(5)
+	p.report()
+	// the totals are only reported once the tree is walked for them
+	if got := buf.String(); !strings.Contains(got, "Copied 1 files, 5 B") {
+		t.Errorf("before totalling got %q", got)
+	}
+	p.wg.Add(1)
+	p.total()
+	buf.Reset()
+	p.report()
+	if got := buf.String(); !strings.Contains(got, "Copied 1/2 files, 5 B/10 B") {
+		t.Errorf("after totalling got %q", got)
+	}
+}
+
+// BenchmarkCopyParallelism compares copying a tree one file at a time with
+// a worker per CPU, see CopyParallelism.
+func BenchmarkCopyParallelism(b *testing.B) {
+	src := benchTree(b)
+	defer func(n int) { CopyParallelism = n }(CopyParallelism)
+	for _, tc := range []struct {
+		name string
+		n    int
+	}{
+		{"serial", 1},
+		{"parallel", runtime.NumCPU()},
+	} {
+		b.Run(tc.name, func(b *testing.B) {
+			CopyParallelism = tc.n
+			benchInstall(b, func(dst string) error { return Copy(src, dst) })
+		})
+	}
+}
@@ -0,0 +1,71 @@
+package cache
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Placeholders in a copy command for the tree to copy and where to.
+const (
+	CopySrc = "{src}"
+	CopyDst = "{dst}"
+)
+
+// CopyCmd, if set, copies trees instead of Copy doing it itself, e.g.
+// "rsync -a {src}/ {dst}" as parsed by ParseCopyCmd. Modes, times and
+// owners are kept as far as the command keeps them.
+var CopyCmd []string
+
+// ParseCopyCmd splits the template tmpl on spaces. It must contain both
+// CopySrc and CopyDst, which are replaced by the paths on each copy.
+func ParseCopyCmd(tmpl string) ([]string, error) {
+	if !strings.Contains(tmpl, CopySrc) || !strings.Contains(tmpl, CopyDst) {
+		return nil, fmt.Errorf("copy command %q must contain both %s and %s", tmpl, CopySrc, CopyDst)
+	}
+	return strings.Fields(tmpl), nil
+}
+
+// copyWithCmd copies the tree at a to b with CopyCmd and then removes the
+// paths matching exclude from b, see excluded.
+func copyWithCmd(a, b string, exclude []string) error {
+	r := strings.NewReplacer(CopySrc, a, CopyDst, b)
+	args := make([]string, len(CopyCmd))
+	for i, arg := range CopyCmd {
+		args[i] = r.Replace(arg)
+	}
+	out, err := exec.Command(args[0], args[1:]...).CombinedOutput()
+	if out = bytes.TrimSpace(out); err != nil && len(out) > 0 {
+		return fmt.Errorf("copying with `%s`: %w: %s", strings.Join(args, " "), err, out)
+	}
+	if err != nil {
+		return fmt.Errorf("copying with `%s`: %w", strings.Join(args, " "), err)
+	}
+	if _, err := os.Lstat(b); err != nil {
+		return fmt.Errorf("`%s` didn't create %s", strings.Join(args, " "), b)
+	}
+
+	if len(exclude) == 0 {
+		return nil
+	}
+	return filepath.Walk(b, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(b, p)
+		if err != nil {
+			return err
+		}
+		if rel == "." || !excluded(filepath.ToSlash(rel), info.IsDir(), exclude) {
+			return nil
+		}
+		err = os.RemoveAll(p)
+		if err == nil && info.IsDir() {
+			return filepath.SkipDir
+		}
+		return err
+	})
+}
@@ -0,0 +1,34 @@
+//go:build !windows
+
+package cache
+
+import (
+	"os"
+	"syscall"
+)
+
+// sameDevice reports whether the existing paths a and b are on the same
+// filesystem. known is false if that can't be told.
+func sameDevice(a, b string) (same, known bool) {
+	infoA, errA := os.Stat(a)
+	infoB, errB := os.Stat(b)
+	if errA != nil || errB != nil {
+		return false, false
+	}
+	stA, okA := infoA.Sys().(*syscall.Stat_t)
+	stB, okB := infoB.Sys().(*syscall.Stat_t)
+	if !okA || !okB {
+		return false, false
+	}
+	return stA.Dev == stB.Dev, true
+}
+
+// diskFree returns the bytes available to us on the filesystem of p.
+func diskFree(p string) (int64, error) {
+	var st syscall.Statfs_t
+	err := syscall.Statfs(p, &st)
+	if err != nil {
+		return 0, err
+	}
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
@@ -0,0 +1,31 @@
+//go:build windows
+
+package cache
+
+import (
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/windows"
+)
+
+// sameDevice reports whether the absolute paths a and b are on the same
+// volume. known is false if that can't be told.
+func sameDevice(a, b string) (same, known bool) {
+	va, vb := filepath.VolumeName(a), filepath.VolumeName(b)
+	if va == "" || vb == "" {
+		return false, false
+	}
+	return strings.EqualFold(va, vb), true
+}
+
+// diskFree returns the bytes available to us on the volume of p.
+func diskFree(p string) (int64, error) {
+	name, err := windows.UTF16PtrFromString(p)
+	if err != nil {
+		return 0, err
+	}
+	var avail uint64
+	err = windows.GetDiskFreeSpaceEx(name, &avail, nil, nil)
+	return int64(avail), err
+}
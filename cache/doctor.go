@@ -0,0 +1,177 @@
+package cache
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+)
+
+// minFree is the free space below which Doctor warns.
+const minFree = 1 << 30
+
+// doctorProbe is the key Doctor asks the remote for. It's not expected to
+// be there, a miss shows the remote answers and accepts our credentials.
+const doctorProbe = "cache-pkgs-doctor-probe"
+
+// Check is the outcome of one of the checks Doctor runs.
+type Check struct {
+	Name string
+	// Err is nil if the check passed.
+	Err error
+	// Critical checks failing break runs, the others only make them
+	// slower or less useful.
+	Critical bool
+	// Detail says what was found.
+	Detail string
+}
+
+// Doctor checks that runs with the store cacheStore, outputs in the
+// current dir and the remote r, if not nil, can work. The store is created
+// if need be, nothing else is left behind.
+func Doctor(cacheStore string, r Remote) []Check {
+	store := Check{Name: "cache dir", Critical: true, Detail: cacheStore}
+	store.Err = checkWritable(cacheStore)
+	if store.Err != nil {
+		// everything else works in the store
+		return []Check{store}
+	}
+	work := tmpDir(filepath.Join(cacheStore, "doctor"))
+	defer os.RemoveAll(work)
+	src := filepath.Join(work, "src")
+	err := os.MkdirAll(src, 0755)
+	if err == nil {
+		err = os.WriteFile(filepath.Join(src, "f"), []byte("doctor\n"), 0644)
+	}
+	if err != nil {
+		store.Err = err
+		return []Check{store}
+	}
+
+	checks := []Check{store}
+	checks = append(checks, checkSymlink(src), checkCopy(src, work), checkHardlink(src))
+
+	free := Check{Name: "free space"}
+	n, err := diskFree(cacheStore)
+	switch {
+	case err != nil:
+		free.Err = err
+	case n < minFree:
+		free.Err = fmt.Errorf("only %s free", FormatSize(n))
+	default:
+		free.Detail = FormatSize(n) + " free"
+	}
+	checks = append(checks, free)
+
+	local := Check{Name: "local filesystem"}
+	fs, err := networkFS(cacheStore)
+	switch {
+	case err != nil:
+		local.Err = err
+	case fs != "":
+		local.Err = fmt.Errorf("cache dir is on a network filesystem (%s), which is slow and may break locking", fs)
+	default:
+		local.Detail = "cache dir is on a local filesystem"
+	}
+	checks = append(checks, local)
+
+	if r != nil {
+		remote := Check{Name: "remote", Critical: true, Detail: r.String()}
+		err := r.Get(doctorProbe, filepath.Join(work, "probe"))
+		if err != nil && !errors.Is(err, ErrCacheMiss) {
+			remote.Err = err
+		}
+		checks = append(checks, remote)
+	}
+	return checks
+}
+
+// checkWritable creates the store dir if needed and writes a file to it.
+func checkWritable(dir string) error {
+	err := CreateStore(dir)
+	if err != nil {
+		return err
+	}
+	p := tmpDir(filepath.Join(dir, "doctor")) + ".probe"
+	err = os.WriteFile(p, nil, 0644)
+	if err != nil {
+		return fmt.Errorf("not writable: %w", err)
+	}
+	return os.Remove(p)
+}
+
+// checkSymlink links the dir src in the store from the current dir, like
+// outputs are installed by default.
+func checkSymlink(src string) Check {
+	c := Check{Name: "symlink", Critical: true, Detail: "output dirs can link to the cache"}
+	link, err := filepath.Abs(tmpDir(".cache-pkgs-doctor"))
+	if err != nil {
+		c.Err = err
+		return c
+	}
+	c.Err = symlinkDir(src, link)
+	if c.Err == nil {
+		defer os.Remove(link)
+		_, c.Err = os.Stat(filepath.Join(link, "f"))
+	}
+	if c.Err != nil {
+		c.Detail = "use -symlink=false"
+	}
+	return c
+}
+
+// checkCopy copies the tree src and compares the result.
+func checkCopy(src, work string) Check {
+	c := Check{Name: "copy", Critical: true, Detail: "trees are copied intact"}
+	dst := filepath.Join(work, "dst")
+	c.Err = Copy(src, dst)
+	if c.Err != nil {
+		return c
+	}
+	a, errA := os.ReadFile(filepath.Join(src, "f"))
+	b, errB := os.ReadFile(filepath.Join(dst, "f"))
+	c.Err = errors.Join(errA, errB)
+	if c.Err == nil && !bytes.Equal(a, b) {
+		c.Err = errors.New("copied file differs")
+	}
+	return c
+}
+
+// checkHardlink hardlinks a file in the store from the current dir, which
+// -hardlink and -cas installs do.
+func checkHardlink(src string) Check {
+	c := Check{Name: "hardlink"}
+	link := tmpDir(".cache-pkgs-doctor")
+	c.Err = os.Link(filepath.Join(src, "f"), link)
+	if c.Err == nil {
+		os.Remove(link)
+		c.Detail = "cache and output dir are on the same filesystem"
+	} else if isCrossDevice(c.Err) {
+		c.Err = errors.New("cache and output dir are on different filesystems, hardlinking copies instead")
+	}
+	return c
+}
+
+// WriteChecks writes the outcome of checks to w, one per line. It reports
+// whether any critical check failed.
+func WriteChecks(w io.Writer, checks []Check) (failed bool) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, c := range checks {
+		status, detail := "ok", c.Detail
+		if c.Err != nil {
+			status, detail = "warn", c.Err.Error()
+			if c.Critical {
+				status, failed = "FAIL", true
+			}
+			if c.Detail != "" {
+				detail += " (" + c.Detail + ")"
+			}
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", status, c.Name, detail)
+	}
+	tw.Flush()
+	return failed
+}
@@ -0,0 +1,105 @@
+package cache
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Plan is what EnsureInstalled would do.
+type Plan struct {
+	Dir     string
+	Cached  bool
+	Remote  Remote
+	Outputs []string
+	Mode    InstallMode
+	Force   bool
+	Merge   bool
+	// Idempotent is Cache.Idempotent.
+	Idempotent bool
+	Subpath    string
+	Cmd        []string
+	// FailOnMiss is Cache.FailOnMiss.
+	FailOnMiss bool
+}
+
+// Plan looks up the entry for k without changing anything and returns what
+// EnsureInstalled would do with it.
+func (c *Cache) Plan(k KeySpec, outputs, cmd []string) (*Plan, error) {
+	keys, err := k.Keys(c.Hash)
+	if err != nil {
+		return nil, err
+	}
+	dir, cached, err := c.lookup(keys)
+	if err != nil {
+		return nil, err
+	}
+	return &Plan{
+		Dir:     dir,
+		Cached:  cached,
+		Remote:  c.Remote,
+		Outputs: outputs,
+		Mode:    c.Mode,
+		Force:   c.Force,
+		Merge:   c.Merge,
+		Subpath: c.Subpath,
+		Cmd:     cmd,
+
+		FailOnMiss: c.FailOnMiss,
+		Idempotent: c.Idempotent,
+	}, nil
+}
+
+// Print writes the plan to w.
+func (p *Plan) Print(w io.Writer) {
+	fmt.Fprintln(w, "key:", filepath.Base(p.Dir))
+	for i, out := range p.Outputs {
+		target := p.Dir
+		if len(p.Outputs) > 1 {
+			target = outputDir(p.Dir, i)
+		}
+		target = filepath.Join(target, filepath.FromSlash(p.Subpath))
+		info, err := os.Lstat(out)
+		switch {
+		case os.IsNotExist(err):
+			fmt.Fprintln(w, "output:", out)
+		case p.Force:
+			fmt.Fprintln(w, "output:", out, "(exists, would be removed)")
+		case p.Merge && info.IsDir():
+			fmt.Fprintln(w, "output:", out, "(exists, would be merged into)")
+		case p.Cached && p.Mode == InstallSymlink && LinksTo(out, target):
+			fmt.Fprintln(w, "output:", out, "(already links to the entry)")
+		case p.Idempotent && p.Mode == InstallSymlink && linksIntoStore(out, filepath.Dir(p.Dir)):
+			fmt.Fprintln(w, "output:", out, "(links to another entry, would be replaced)")
+		default:
+			fmt.Fprintln(w, "output:", out, "(exists, the run would fail without -f)")
+		}
+	}
+
+	cmd := strings.Join(p.Cmd, " ")
+	switch {
+	case p.Cached:
+		fmt.Fprintln(w, "status: hit")
+		if _, err := os.Stat(archivePath(p.Dir)); err == nil {
+			fmt.Fprintln(w, "action: extract the cached archive")
+		} else if _, err := os.Stat(casPath(p.Dir)); err == nil {
+			fmt.Fprintln(w, "action: materialize the cached tree from its blobs")
+		} else {
+			fmt.Fprintf(w, "action: %s the cached tree\n", p.Mode)
+		}
+	case p.FailOnMiss && p.Remote != nil:
+		fmt.Fprintln(w, "status: miss")
+		fmt.Fprintf(w, "action: pull from %s, or fail\n", p.Remote)
+	case p.FailOnMiss:
+		fmt.Fprintln(w, "status: miss")
+		fmt.Fprintln(w, "action: fail")
+	case p.Remote != nil:
+		fmt.Fprintln(w, "status: miss")
+		fmt.Fprintf(w, "action: pull from %s, or run `%s` and cache the output\n", p.Remote, cmd)
+	default:
+		fmt.Fprintln(w, "status: miss")
+		fmt.Fprintf(w, "action: run `%s` and cache the output\n", cmd)
+	}
+}
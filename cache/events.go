@@ -0,0 +1,67 @@
+package cache
+
+import "time"
+
+// CacheEvent is passed to Cache.OnEvent as an entry is looked up and
+// generated. It is one of *HitEvent, *MissEvent, *GenerateStartEvent and
+// *GenerateDoneEvent.
+type CacheEvent interface {
+	cacheEvent()
+}
+
+// HitEvent is sent once a cached entry has been installed, or found by
+// Warm.
+type HitEvent struct {
+	Key string
+	// Entry is the cache entry dir.
+	Entry   string
+	Outputs []string
+	// Lookup is how long hashing and finding the entry took, including
+	// fetching it from the Remote.
+	Lookup time.Duration
+	// Install is how long installing the entry and PostInstall took, 0
+	// for Warm.
+	Install time.Duration
+}
+
+// MissEvent is sent when the entry is neither in the store nor the
+// Remote, before it is generated.
+type MissEvent struct {
+	Key     string
+	Entry   string
+	Outputs []string
+	Lookup  time.Duration
+}
+
+// GenerateStartEvent is sent before the command is run on a miss.
+type GenerateStartEvent struct {
+	Key     string
+	Outputs []string
+	Cmd     []string
+}
+
+// GenerateDoneEvent is sent once the command has run and its output was
+// cached, or either failed. Duration includes retries and copying the
+// outputs into the store.
+type GenerateDoneEvent struct {
+	Key      string
+	Entry    string
+	Outputs  []string
+	Cmd      []string
+	Duration time.Duration
+	// ExitCode is that of an accepted exit, see Cache.AcceptExitCodes.
+	ExitCode int
+	Err      error
+}
+
+func (*HitEvent) cacheEvent()           {}
+func (*MissEvent) cacheEvent()          {}
+func (*GenerateStartEvent) cacheEvent() {}
+func (*GenerateDoneEvent) cacheEvent()  {}
+
+// emit passes ev to OnEvent, if set.
+func (c *Cache) emit(ev CacheEvent) {
+	if c.OnEvent != nil {
+		c.OnEvent(ev)
+	}
+}
@@ -0,0 +1,160 @@
+package cache
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Evict removes the least recently used entries from cacheStore until it
+// takes up at most maxSize bytes. Pinned entries and those locked by a
+// generating process, including our own, are never removed, though pinned
+// ones count towards the size. Blobs only the removed entries
+// referenced are pruned.
+func Evict(cacheStore string, maxSize int64) error {
+	entries, err := Entries(cacheStore)
+	if err == nil {
+		err = EntrySizes(entries)
+	}
+	if err != nil {
+		return err
+	}
+
+	var total int64
+	for _, e := range entries {
+		total += e.Size
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].LastUsed.Before(entries[j].LastUsed)
+	})
+
+	for _, e := range entries {
+		if total <= maxSize {
+			break
+		}
+		if e.Pinned {
+			continue
+		}
+		removed, err := removeUnlocked(e)
+		if err != nil {
+			return err
+		}
+		if removed {
+			Progressf("Evicted %s (%s, last used %s)", e.Key, FormatSize(e.Size), e.LastUsed.Format(timeFormat))
+			total -= e.Size
+		}
+	}
+	return PruneBlobs(cacheStore)
+}
+
+// Expire removes entries from cacheStore which were cached more than
+// maxAge ago. Pinned entries and those locked by a generating process are
+// never removed. With dryRun it only reports what it would remove.
+func Expire(cacheStore string, maxAge time.Duration, dryRun bool) error {
+	entries, err := Entries(cacheStore)
+	if err != nil {
+		return err
+	}
+
+	cutoff := time.Now().Add(-maxAge)
+	for _, e := range entries {
+		if dryRun {
+			if e.Created.Before(cutoff) && !e.Pinned {
+				Progressf("Would expire %s (cached %s)", e.Key, e.Created.Format(timeFormat))
+			}
+			continue
+		}
+		err := fixFuture(e)
+		if err != nil {
+			return err
+		}
+		if !e.Created.Before(cutoff) || e.Pinned {
+			continue
+		}
+		removed, err := removeUnlocked(e)
+		if err != nil {
+			return err
+		}
+		if removed {
+			Progressf("Expired %s (cached %s)", e.Key, e.Created.Format(timeFormat))
+		}
+	}
+	if dryRun {
+		return nil
+	}
+	return PruneBlobs(cacheStore)
+}
+
+// removeUnlocked removes e unless it is locked.
+func removeUnlocked(e Entry) (removed bool, err error) {
+	l, err := TryLockEntry(e.Dir)
+	if err == ErrLocked {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer l.Unlock()
+	return true, RemoveEntry(e.Dir)
+}
+
+// ParseAge parses durations like "30d", "12h" or "1d12h". Besides the
+// units understood by time.ParseDuration it accepts a leading number of
+// days.
+func ParseAge(s string) (time.Duration, error) {
+	var days time.Duration
+	rest := s
+	if i := strings.Index(s, "d"); i >= 0 {
+		n, err := strconv.Atoi(s[:i])
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		days, rest = time.Duration(n)*24*time.Hour, s[i+1:]
+		if rest == "" {
+			return days, nil
+		}
+	}
+
+	d, err := time.ParseDuration(rest)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	return days + d, nil
+}
+
+var sizeUnits = []string{"B", "KB", "MB", "GB", "TB"}
+
+// ParseSize parses sizes like "512MB", "5GB" or "1024". Units are powers of
+// 1024 and the B is optional, i.e. "5G" is "5GB".
+func ParseSize(s string) (int64, error) {
+	num := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B")
+	mult := int64(1)
+	if num != "" {
+		if i := strings.Index("KMGT", num[len(num)-1:]); i >= 0 {
+			mult = 1 << (10 * uint(i+1))
+			num = strings.TrimSpace(num[:len(num)-1])
+		}
+	}
+
+	n, err := strconv.ParseFloat(num, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(n * float64(mult)), nil
+}
+
+// FormatSize formats n bytes for humans.
+func FormatSize(n int64) string {
+	f := float64(n)
+	i := 0
+	for f >= 1024 && i < len(sizeUnits)-1 {
+		f /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%d B", n)
+	}
+	return fmt.Sprintf("%.1f %s", f, sizeUnits[i])
+}
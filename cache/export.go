@@ -0,0 +1,247 @@
+package cache
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Names of the members of an export, in the order they are written.
+const (
+	exportInfoName     = "export.json"
+	exportManifestName = "manifest.json"
+	exportEntryName    = "entry.tar"
+)
+
+// exportInfo identifies the entry in an export.
+type exportInfo struct {
+	Key string `json:"key"`
+	// Digest is the hash of the entry archive, computed with the
+	// algorithm of the key.
+	Digest string `json:"digest"`
+}
+
+// keyAlgo returns the hash algorithm key was computed with.
+func keyAlgo(key string) string {
+	if i := strings.Index(key, "-"); i > 0 && hashAlgos[key[:i]] != nil {
+		return key[:i]
+	}
+	return legacyAlgo
+}
+
+// validKey reports whether key can name an entry in the store.
+func validKey(key string) bool {
+	return key != "" && key != "." && key != ".." &&
+		filepath.Base(key) == key && !strings.Contains(key, tmpMarker)
+}
+
+// Export writes the entry for key, with its manifest, to w as a tar to be
+// read by Import.
+func (c *Cache) Export(key string, w io.Writer) error {
+	dir := filepath.Join(c.NamespaceDir(), key)
+	ok, err := EntryExists(dir)
+	if err != nil {
+		return err
+	}
+	if !validKey(key) || !ok {
+		return fmt.Errorf("no cache entry %s", key)
+	}
+
+	archive := archivePath(dir)
+	if _, err := os.Stat(archive); err != nil {
+		archive = tmpDir(dir) + archiveExt
+		defer os.Remove(archive)
+		err := writeEntryArchive(archive, c.Compression, dir)
+		if err != nil {
+			return err
+		}
+	}
+
+	digest, err := hashFile(archive, hashAlgos[keyAlgo(key)])
+	if err != nil {
+		return err
+	}
+	info, err := json.Marshal(exportInfo{Key: key, Digest: digest})
+	if err != nil {
+		return err
+	}
+
+	tw := tar.NewWriter(w)
+	err = writeMember(tw, exportInfoName, info)
+	if err != nil {
+		return err
+	}
+
+	m, err := os.ReadFile(manifestPath(dir))
+	if err == nil {
+		err = writeMember(tw, exportManifestName, m)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	f, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	err = tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     exportEntryName,
+		Mode:     0644,
+		Size:     st.Size(),
+		ModTime:  st.ModTime(),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+func writeMember(tw *tar.Writer, name string, b []byte) error {
+	err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     0644,
+		Size:     int64(len(b)),
+		ModTime:  time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = tw.Write(b)
+	return err
+}
+
+// Import adds the entry in the export r to the store and returns its key.
+// The entry is refused if it doesn't match the digest recorded for it or
+// its manifest was hashed with another algorithm than its key. An entry
+// already in the store is left as is.
+func (c *Cache) Import(r io.Reader) (key string, err error) {
+	if c.ReadOnly {
+		return "", ErrReadOnly
+	}
+	var info *exportInfo
+	var m *Manifest
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return "", errors.New("export has no entry")
+		}
+		if err != nil {
+			return "", err
+		}
+
+		switch hdr.Name {
+		case exportInfoName:
+			info = &exportInfo{}
+			err = json.NewDecoder(tr).Decode(info)
+			if err != nil {
+				return "", fmt.Errorf("bad %s: %w", exportInfoName, err)
+			}
+			if !validKey(info.Key) {
+				return "", fmt.Errorf("bad key %q in export", info.Key)
+			}
+		case exportManifestName:
+			m = &Manifest{}
+			err = json.NewDecoder(tr).Decode(m)
+			if err != nil {
+				return "", fmt.Errorf("bad %s: %w", exportManifestName, err)
+			}
+		case exportEntryName:
+			if info == nil {
+				return "", fmt.Errorf("export has no %s before the entry", exportInfoName)
+			}
+			if m != nil && m.Hash != "" && m.Hash != keyAlgo(info.Key) {
+				return "", fmt.Errorf("key %s wasn't hashed with %s as its manifest says, refusing to import", info.Key, m.Hash)
+			}
+			return info.Key, c.importEntry(info, m, tr)
+		}
+	}
+}
+
+func (c *Cache) importEntry(info *exportInfo, m *Manifest, r io.Reader) error {
+	dir := filepath.Join(c.NamespaceDir(), info.Key)
+	lock, err := LockEntry(dir, c.LockTimeout)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	if ok, err := EntryExists(dir); ok || err != nil {
+		if ok {
+			Progressf("%s is cached already", info.Key)
+		}
+		return err
+	}
+
+	tmp := tmpDir(dir)
+	archive := tmp + archiveExt
+	defer os.Remove(archive)
+
+	f, err := os.Create(archive)
+	if err != nil {
+		return err
+	}
+	h := hashAlgos[keyAlgo(info.Key)]()
+	_, err = io.Copy(io.MultiWriter(f, h), r)
+	if errClose := f.Close(); err == nil {
+		err = errClose
+	}
+	if err != nil {
+		return err
+	}
+	if digest := fmt.Sprintf("%x", h.Sum(nil)); digest != info.Digest {
+		return fmt.Errorf("entry %s doesn't match its digest, refusing to import", info.Key)
+	}
+
+	stored := archive
+	if !c.Archive {
+		err = extractArchiveFile(archive, tmp)
+		if err != nil {
+			return err
+		}
+		// the digest covers the mode of the root, which CommitDir sets
+		err = os.Chmod(tmp, DirMode)
+		if err != nil {
+			os.RemoveAll(tmp)
+			return err
+		}
+		stored = tmp
+	}
+	if m != nil {
+		if m.Digest != "" {
+			// Verify hashes the entry as stored, which may be unpacked
+			// here where it was archived in the exporting store, or the
+			// other way around
+			m.Digest, err = hashFile(stored, hashAlgos[keyAlgo(info.Key)])
+		}
+		if err == nil {
+			err = WriteManifest(dir, m)
+		}
+		if err != nil {
+			os.RemoveAll(tmp)
+			return err
+		}
+	}
+	if c.Archive {
+		return CommitArchive(archive, dir)
+	}
+	return CommitDir(tmp, dir)
+}
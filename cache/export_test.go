@@ -0,0 +1,51 @@
+package cache
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+)
+
+// TestImportVerifies imports entries into stores keeping them in another
+// format than the exporting one, which -verify must still accept.
+func TestImportVerifies(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		from, to bool
+	}{
+		{"archive to dir", true, false},
+		{"dir to archive", false, true},
+		{"dir to dir", false, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			from, spec, dir := testCache(t, InstallCopy)
+			from.Archive, from.Verify = tc.from, true
+			out := filepath.Join(dir, "out")
+			ensure(t, from, spec, out, helperCmd(t, "write", out, "f", "bin/tool:755"))
+			entries, err := Entries(from.NamespaceDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			var export bytes.Buffer
+			err = from.Export(entries[0].Key, &export)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			to, spec, dir := testCache(t, InstallCopy)
+			to.Archive, to.Verify = tc.to, true
+			key, err := to.Import(&export)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ok, err := Verify(filepath.Join(to.NamespaceDir(), key))
+			if err != nil || !ok {
+				t.Fatalf("the imported entry fails verification: %v", err)
+			}
+			out = filepath.Join(dir, "out")
+			if !ensure(t, to, spec, out, helperCmd(t, "fail", out)) {
+				t.Error("the imported entry wasn't hit")
+			}
+		})
+	}
+}
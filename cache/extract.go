@@ -0,0 +1,143 @@
+package cache
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// With an extraction cache (InstallOptions.ExtractCacheSize) archived
+// entries are extracted once into the extracted dir of the store and
+// installed from there like unpacked entries, so they can be symlinked and
+// hardlinked while the canonical copy stays compressed. Extracted trees are
+// evicted least recently used first, which breaks outputs symlinked to
+// them until the next run installs them again.
+const (
+	extractedDir = "extracted"
+	// extractGrace protects recently used trees from eviction, as they may
+	// still be installed from.
+	extractGrace = 10 * time.Minute
+)
+
+// extractedPath returns where the cache entry dir is kept extracted.
+func extractedPath(dir string) string {
+	return filepath.Join(filepath.Dir(dir), extractedDir, filepath.Base(dir))
+}
+
+// installSource returns the tree the cache entry dir is installed from
+// with opts.
+func installSource(dir string, opts InstallOptions) string {
+	if opts.ExtractCacheSize <= 0 {
+		return dir
+	}
+	if _, err := os.Stat(archivePath(dir)); err != nil {
+		return dir
+	}
+	return extractedPath(dir)
+}
+
+// extracted returns the extracted tree of the archived cache entry dir,
+// extracting it first if it isn't yet. Then the extracted trees are cut
+// down to maxSize bytes.
+func extracted(dir string, maxSize int64) (string, error) {
+	p := extractedPath(dir)
+	ok, err := IsDir(p)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		Progress("Extracting the cached archive for reuse")
+		err = mkdirStore(filepath.Dir(p))
+		if err != nil {
+			return "", err
+		}
+		tmp := tmpDir(p)
+		err = extractArchiveFile(archivePath(dir), tmp)
+		if err == nil {
+			err = os.Rename(tmp, p)
+		}
+		if err != nil {
+			os.RemoveAll(tmp)
+			if ok, _ := IsDir(p); !ok {
+				return "", err
+			}
+			// extracted by someone else meanwhile
+		}
+	}
+	err = Touch(p)
+	if err != nil {
+		return "", err
+	}
+	return p, evictExtracted(filepath.Dir(p), maxSize)
+}
+
+// evictExtracted removes the least recently used trees in the extraction
+// cache dir until they take up at most maxSize bytes. Trees used within
+// extractGrace are kept.
+func evictExtracted(dir string, maxSize int64) error {
+	names, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	type tree struct {
+		path     string
+		size     int64
+		lastUsed time.Time
+	}
+	var trees []tree
+	var total int64
+	for _, d := range names {
+		if !d.IsDir() || strings.Contains(d.Name(), tmpMarker) {
+			continue
+		}
+		t := tree{path: filepath.Join(dir, d.Name())}
+		t.size, err = dirSize(t.path)
+		if err != nil {
+			return err
+		}
+		if info, err := os.Stat(usedPath(t.path)); err == nil {
+			t.lastUsed = info.ModTime()
+		}
+		trees = append(trees, t)
+		total += t.size
+	}
+	sort.Slice(trees, func(i, j int) bool {
+		return trees[i].lastUsed.Before(trees[j].lastUsed)
+	})
+
+	cutoff := time.Now().Add(-extractGrace)
+	for _, t := range trees {
+		if total <= maxSize || t.lastUsed.After(cutoff) {
+			break
+		}
+		err := removeExtracted(t.path)
+		if err != nil {
+			return err
+		}
+		Progressf("Evicted extracted %s (%s)", filepath.Base(t.path), FormatSize(t.size))
+		total -= t.size
+	}
+	return nil
+}
+
+// removeExtracted removes the extracted tree p. It's moved out of the way
+// first, so nobody installs from it half removed.
+func removeExtracted(p string) error {
+	tmp := tmpDir(p)
+	err := os.Rename(p, tmp)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err == nil {
+		err = os.RemoveAll(tmp)
+	}
+	if err == nil {
+		err = os.Remove(usedPath(p))
+	}
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,127 @@
+package cache
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// GCPolicy is what GC removes besides leftovers of crashed runs.
+type GCPolicy struct {
+	// MaxSize evicts the least recently used entries until the store
+	// takes up at most that many bytes. 0 keeps them.
+	MaxSize int64
+	// MaxAge removes entries cached longer ago. 0 keeps them.
+	MaxAge time.Duration
+	// DryRun only reports what would be removed.
+	DryRun bool
+}
+
+// GC tidies cacheStore and each of its namespaces in one pass: temporary
+// dirs of crashed runs, entries p expires or evicts and blobs no longer
+// referenced are removed. Pinned entries and those in use by other runs
+// are left alone. It
+// returns the bytes reclaimed, or that would be with DryRun.
+func GC(cacheStore string, p GCPolicy) (reclaimed int64, err error) {
+	verb := "Removed"
+	if p.DryRun {
+		verb = "Would remove"
+	}
+
+	leftovers, err := leftoverTmp(cacheStore)
+	if err != nil {
+		return 0, err
+	}
+	for _, t := range leftovers {
+		size, _ := dirSize(t)
+		if !p.DryRun {
+			err = os.RemoveAll(t)
+			if err != nil {
+				return reclaimed, err
+			}
+		}
+		Progressf("%s leftover %s (%s)", verb, filepath.Base(t), FormatSize(size))
+		reclaimed += size
+	}
+
+	entries, err := sizedEntries(cacheStore)
+	if err != nil {
+		return reclaimed, err
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].LastUsed.Before(entries[j].LastUsed)
+	})
+	var total int64
+	for _, e := range entries {
+		total += e.Size
+	}
+
+	remove := func(e Entry, why string) (bool, error) {
+		if !p.DryRun {
+			removed, err := removeUnlocked(e)
+			if err != nil || !removed {
+				return false, err
+			}
+		}
+		Progressf("%s %s (%s, %s)", verb, e.Key, FormatSize(e.Size), why)
+		reclaimed += e.Size
+		total -= e.Size
+		return true, nil
+	}
+
+	var kept []Entry
+	cutoff := time.Now().Add(-p.MaxAge)
+	for _, e := range entries {
+		if !p.DryRun {
+			err = fixFuture(e)
+			if err != nil {
+				return reclaimed, err
+			}
+		}
+		removed := false
+		if e.Pinned {
+			continue
+		}
+		if p.MaxAge > 0 && e.Created.Before(cutoff) {
+			removed, err = remove(e, "cached "+e.Created.Format(timeFormat))
+			if err != nil {
+				return reclaimed, err
+			}
+		}
+		if !removed {
+			kept = append(kept, e)
+		}
+	}
+	for _, e := range kept {
+		if p.MaxSize <= 0 || total <= p.MaxSize {
+			break
+		}
+		_, err = remove(e, "last used "+e.LastUsed.Format(timeFormat))
+		if err != nil {
+			return reclaimed, err
+		}
+	}
+
+	n, freed, err := pruneBlobs(cacheStore, p.DryRun)
+	if n > 0 {
+		Progressf("%s %d unreferenced blobs (%s)", verb, n, FormatSize(freed))
+		reclaimed += freed
+	}
+	if err != nil {
+		return reclaimed, err
+	}
+
+	namespaces, err := Namespaces(cacheStore)
+	if err != nil {
+		return reclaimed, err
+	}
+	for _, ns := range namespaces {
+		freed, err := GC(filepath.Join(cacheStore, ns), p)
+		reclaimed += freed
+		if err != nil {
+			return reclaimed, err
+		}
+	}
+	return reclaimed, nil
+}
@@ -0,0 +1,170 @@
+package cache
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ExpandGlobs expands patterns into a sorted list of unique paths. Besides
+// the filepath.Match syntax a "**" path element matches any number of
+// directories. Every pattern must match at least one path.
+func ExpandGlobs(patterns []string) ([]string, error) {
+	seen := map[string]bool{}
+	var matches []string
+	for _, pattern := range patterns {
+		m, err := expandGlob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		if len(m) == 0 {
+			return nil, fmt.Errorf("glob %q did not match any files", pattern)
+		}
+		for _, p := range m {
+			if !seen[p] {
+				seen[p] = true
+				matches = append(matches, p)
+			}
+		}
+	}
+	sort.Strings(matches)
+	return matches, nil
+}
+
+func expandGlob(pattern string) ([]string, error) {
+	pattern = filepath.Clean(pattern)
+	if !strings.Contains(pattern, "**") {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("bad glob %q: %w", pattern, err)
+		}
+		return matches, nil
+	}
+
+	// walk from the longest leading part without any meta characters
+	elems := strings.Split(filepath.ToSlash(pattern), "/")
+	i := 0
+	for i < len(elems)-1 && !hasMeta(elems[i]) {
+		i++
+	}
+	root := filepath.FromSlash(strings.Join(elems[:i], "/"))
+	if root == "" {
+		root = "."
+		if strings.HasPrefix(pattern, string(filepath.Separator)) {
+			root = string(filepath.Separator)
+		}
+	}
+	elems = elems[i:]
+
+	// validate the pattern up front, Walk would just silently match nothing
+	for _, e := range elems {
+		if _, err := filepath.Match(e, ""); err != nil {
+			return nil, fmt.Errorf("bad glob %q: %w", pattern, err)
+		}
+	}
+
+	var matches []string
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil || rel == "." {
+			return err
+		}
+		if matchElems(elems, strings.Split(filepath.ToSlash(rel), "/")) {
+			matches = append(matches, p)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return matches, nil
+}
+
+// matchElems matches path elements against pattern elements where a "**"
+// pattern element matches zero or more path elements.
+func matchElems(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchElems(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		ok, _ := filepath.Match(pattern[0], name[0])
+		if !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+func hasMeta(elem string) bool {
+	return strings.ContainsAny(elem, `*?[\`)
+}
+
+// excluded reports whether rel, a slash separated path relative to an
+// output, is excluded by patterns. They work like in .gitignore: a
+// pattern without a slash matches a name at any depth, others match the
+// whole of rel with "**" as in ExpandGlobs. A leading slash anchors a
+// pattern to the output dir, a trailing one makes it match dirs only and
+// a leading "!" includes what earlier patterns excluded. The last pattern
+// matching decides.
+func excluded(rel string, isDir bool, patterns []string) bool {
+	ex := false
+	for _, p := range patterns {
+		negate := strings.HasPrefix(p, "!")
+		p = strings.TrimPrefix(p, "!")
+		if strings.HasSuffix(p, "/") {
+			if !isDir {
+				continue
+			}
+			p = strings.TrimSuffix(p, "/")
+		}
+		var ok bool
+		if !strings.Contains(p, "/") {
+			ok, _ = path.Match(p, path.Base(rel))
+		} else {
+			ok = matchElems(strings.Split(strings.TrimPrefix(p, "/"), "/"), strings.Split(rel, "/"))
+		}
+		if ok {
+			ex = !negate
+		}
+	}
+	return ex
+}
+
+// ignoreFile in the root of an output dir lists paths to leave out of the
+// cache, one pattern per line as for excluded. It is never cached itself.
+const ignoreFile = ".cacheignore"
+
+// outputExcludes returns the patterns leaving paths of the output dir out
+// of the cache: those of its ignoreFile followed by exclude, so the latter
+// take precedence.
+func outputExcludes(out string, exclude []string) ([]string, error) {
+	b, err := os.ReadFile(filepath.Join(out, ignoreFile))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	var patterns []string
+	for _, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimRight(line, "\r ")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		patterns = append(patterns, line)
+	}
+	patterns = append(patterns, exclude...)
+	return append(patterns, "/"+ignoreFile), nil
+}
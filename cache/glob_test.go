@@ -0,0 +1,80 @@
+package cache
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExcludedNested(t *testing.T) {
+	for _, tc := range []struct {
+		pattern, rel string
+		isDir, want  bool
+	}{
+		{".cache", ".cache", true, true},
+		{".cache", "a/b/.cache", true, true},
+		{".cache/", "a/b/.cache", false, false},
+		{"**/.cache/", "a/b/.cache", true, true},
+		{"a/**/build", "a/build", true, true},
+		{"a/**/build", "a/x/y/build", true, true},
+		{"a/**/build", "b/x/build", true, false},
+		{"/a/*.o", "a/x.o", false, true},
+		{"/a/*.o", "b/a/x.o", false, false},
+		{"pkg/*/dist", "pkg/web/dist", true, true},
+		{"pkg/*/dist", "pkg/web/sub/dist", true, false},
+	} {
+		got := excluded(tc.rel, tc.isDir, []string{tc.pattern})
+		if got != tc.want {
+			t.Errorf("excluded(%q, %v, [%q]) = %v, want %v", tc.rel, tc.isDir, tc.pattern, got, tc.want)
+		}
+	}
+
+	// the last matching pattern decides
+	patterns := []string{"**/.cache/", "!keep/.cache/"}
+	if excluded("keep/.cache", true, patterns) {
+		t.Error("keep/.cache is excluded despite the negation")
+	}
+	if !excluded("drop/.cache", true, patterns) {
+		t.Error("drop/.cache isn't excluded")
+	}
+}
+
+func TestExcludeRoundTrip(t *testing.T) {
+	kept := []string{"pkg/index.js", "pkg/keep/.cache/f", "pkg/lib/x.o"}
+	dropped := []string{".cache/f", "pkg/sub/.cache/f", "build/x.o"}
+	for _, format := range []string{FormatDir, FormatArchive, FormatCAS} {
+		t.Run(format, func(t *testing.T) {
+			c, spec, dir := testCache(t, InstallCopy)
+			c.Archive, c.CAS = format == FormatArchive, format == FormatCAS
+			out := filepath.Join(dir, "out")
+			k := KeySpec{Files: []string{spec}, Exclude: []string{"**/.cache/", "!pkg/keep/.cache/", "/build/*.o"}}
+			cmd := helperCmd(t, append([]string{"write", out}, append(kept, dropped...)...)...)
+
+			for _, wantHit := range []bool{false, true} {
+				hit, err := c.EnsureInstalled(k, []string{out}, cmd)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if hit != wantHit {
+					t.Fatalf("hit is %v, want %v", hit, wantHit)
+				}
+				if !hit {
+					err = os.RemoveAll(out)
+					if err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			for _, rel := range kept {
+				if _, err := os.Stat(filepath.Join(out, filepath.FromSlash(rel))); err != nil {
+					t.Errorf("%s wasn't restored: %v", rel, err)
+				}
+			}
+			for _, rel := range dropped {
+				if _, err := os.Stat(filepath.Join(out, filepath.FromSlash(rel))); !os.IsNotExist(err) {
+					t.Errorf("excluded %s was restored", rel)
+				}
+			}
+		})
+	}
+}
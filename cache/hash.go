@@ -0,0 +1,214 @@
+package cache
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// legacyAlgo is the algorithm used before -hash existed. Entries keyed by it
+// carry no algorithm prefix.
+const legacyAlgo = "sha1"
+
+var hashAlgos = map[string]func() hash.Hash{
+	"sha1":    sha1.New,
+	"sha256":  sha256.New,
+	"sha512":  sha512.New,
+	"blake2b": newBlake2b,
+}
+
+func newBlake2b() hash.Hash {
+	// only fails for keys longer than 64 bytes
+	h, _ := blake2b.New256(nil)
+	return h
+}
+
+// HashAlgoNames lists the supported hash algorithms.
+func HashAlgoNames() string {
+	var names []string
+	for name := range hashAlgos {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// hashFiles hashes the combined contents of files with algo, normalized as
+// given by normalize (see Normalize). Symlinks in dirs are followed if
+// follow is set, see hashDir, files which are symlinks unless noFollow is.
+// Each file is hashed along with its name, as given or the one at the same
+// index of names if not nil, so swapping the contents of two files changes
+// the result but their order doesn't. A single file hashes the same as
+// with hashSpec. memo, if not nil, remembers the hashes of unchanged
+// files.
+func hashFiles(files, names []string, algo, normalize string, follow, noFollow bool, memo *hashMemo) (string, error) {
+	if len(files) == 1 {
+		return hashSpec(files[0], algo, normalize, follow, noFollow, memo)
+	}
+
+	newHash := hashAlgos[algo]
+	type named struct{ name, sum string }
+	sums := make([]named, 0, len(files))
+	for i, fname := range files {
+		sum, err := hashSpec(fname, algo, normalize, follow, noFollow, memo)
+		if err != nil {
+			return "", err
+		}
+		name := fname
+		if names != nil {
+			name = names[i]
+		}
+		sums = append(sums, named{filepath.ToSlash(filepath.Clean(name)), sum})
+	}
+	sort.Slice(sums, func(i, j int) bool {
+		if sums[i].name != sums[j].name {
+			return sums[i].name < sums[j].name
+		}
+		return sums[i].sum < sums[j].sum
+	})
+
+	h := newHash()
+	for _, s := range sums {
+		fmt.Fprintf(h, "%s  %s\n", s.sum, s.name)
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// hashFile hashes the contents of fname. If fname is a directory the whole
+// tree below it is hashed, see hashDir.
+func hashFile(fname string, newHash func() hash.Hash) (hash string, err error) {
+	return hashPath(fname, newHash, false)
+}
+
+// hashPath is hashFile, following symlinks in directories if follow is set.
+func hashPath(fname string, newHash func() hash.Hash, follow bool) (hash string, err error) {
+	info, err := os.Stat(fname)
+	if err != nil {
+		return "", err
+	}
+	if info.IsDir() {
+		return hashDir(fname, newHash, follow)
+	}
+
+	h := newHash()
+	f, err := os.Open(fname)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// hashDir hashes the tree rooted at dir. Every entry contributes its path
+// relative to dir, its mode and a digest of its contents, so renames and
+// permission changes yield a new hash. Entries are visited in lexical order
+// which keeps the hash stable across machines.
+//
+// Symlinks are hashed by their target unless follow is set, in which case
+// what they point to is hashed as if it was in their place. Links that
+// dangle, or point to a dir they are inside of and would otherwise be
+// walked forever, are hashed by their target regardless.
+func hashDir(dir string, newHash func() hash.Hash, follow bool) (string, error) {
+	h := newHash()
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return "", err
+	}
+	err = hashEntry(h, dir, ".", info, newHash, follow, nil)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// hashEntry adds the entry p, at rel within the tree, and everything below
+// it to h. parents are the real paths of the dirs p is inside of.
+func hashEntry(h io.Writer, p, rel string, info os.FileInfo, newHash func() hash.Hash, follow bool, parents []string) error {
+	if follow && info.Mode()&os.ModeSymlink != 0 {
+		if target, ok := followLink(p, parents); ok {
+			info = target
+		}
+	}
+
+	var sum string
+	switch mode := info.Mode(); {
+	case mode&os.ModeSymlink != 0:
+		target, err := os.Readlink(p)
+		if err != nil {
+			return err
+		}
+		th := newHash()
+		io.WriteString(th, target)
+		sum = fmt.Sprintf("%x", th.Sum(nil))
+	case mode.IsRegular():
+		var err error
+		sum, err = hashPath(p, newHash, false)
+		if err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(h, "%o %s %s\n", uint32(info.Mode()), sum, filepath.ToSlash(rel))
+	if !info.IsDir() {
+		return nil
+	}
+
+	if follow {
+		real, err := filepath.EvalSymlinks(p)
+		if err != nil {
+			return err
+		}
+		parents = append(parents, real)
+	}
+	entries, err := os.ReadDir(p)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		child := filepath.Join(p, e.Name())
+		info, err := os.Lstat(child)
+		if err != nil {
+			return err
+		}
+		err = hashEntry(h, child, filepath.Join(rel, e.Name()), info, newHash, follow, parents)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// followLink returns what the symlink p points to, unless it dangles or is
+// a dir in parents or one of theirs.
+func followLink(p string, parents []string) (os.FileInfo, bool) {
+	info, err := os.Stat(p)
+	if err != nil {
+		return nil, false
+	}
+	if info.IsDir() {
+		real, err := filepath.EvalSymlinks(p)
+		if err != nil {
+			return nil, false
+		}
+		for _, parent := range parents {
+			if real == parent {
+				return nil, false
+			}
+		}
+	}
+	return info, true
+}
@@ -0,0 +1,46 @@
+package cache
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestHashFiles(t *testing.T) {
+	dir := t.TempDir()
+	a, b := filepath.Join(dir, "a.json"), filepath.Join(dir, "b.lock")
+	hash := func(files ...string) string {
+		t.Helper()
+		sum, err := hashFiles(files, nil, "sha256", "", false, false, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sum
+	}
+	write := func(contentA, contentB string) {
+		t.Helper()
+		for p, content := range map[string]string{a: contentA, b: contentB} {
+			err := writeFile(p, content, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	write("x", "y")
+	sum := hash(a, b)
+	if hash(b, a) != sum {
+		t.Error("the order of the files changes the hash")
+	}
+	single, err := hashSpec(a, "sha256", "", false, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash(a) != single {
+		t.Error("a single file doesn't hash as with hashSpec")
+	}
+
+	write("y", "x")
+	if hash(a, b) == sum {
+		t.Error("swapping the contents of the files doesn't change the hash")
+	}
+}
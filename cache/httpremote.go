@@ -0,0 +1,232 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// TokenEnv names the environment variable holding the bearer token sent to
+// http(s) remotes.
+const TokenEnv = "CACHE_PKGS_TOKEN"
+
+// httpAttempts is how often Get tries to complete a download. Interrupted
+// downloads are resumed with a Range request if the server supports it.
+const httpAttempts = 4
+
+// httpRemote stores entries as "<url>/<key>.tar.gz" on a plain HTTP server
+// supporting GET and PUT, next to the SHA-256 of the archive as
+// "<url>/<key>.tar.gz.sha256". Downloads are checked against it, if there.
+type httpRemote struct {
+	base  string
+	token string
+}
+
+func newHTTPRemote(u *url.URL) *httpRemote {
+	return &httpRemote{
+		base:  strings.TrimSuffix(u.String(), "/"),
+		token: os.Getenv(TokenEnv),
+	}
+}
+
+func (r *httpRemote) String() string {
+	return r.base
+}
+
+func (r *httpRemote) Get(key, dst string) error {
+	want, err := r.digest(key)
+	if err != nil {
+		return err
+	}
+	for resume := true; ; resume = false {
+		resumed, err := r.fetch(key, dst, resume)
+		if err == nil && want != "" {
+			err = checkDigest(dst, want)
+		}
+		if err == nil || !resumed {
+			return err
+		}
+		Progressf("Resumed download of %s is broken (%v) - downloading it again", key, err)
+	}
+}
+
+// digest returns the digest stored for the archive of key, or "" if there
+// is none.
+func (r *httpRemote) digest(key string) (string, error) {
+	resp, err := r.do("GET", archiveName(key)+".sha256", nil, 0, nil)
+	if errors.Is(err, ErrCacheMiss) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return strings.TrimSpace(string(b)), err
+}
+
+func checkDigest(p, want string) error {
+	got, err := hashFile(p, sha256.New)
+	if err != nil {
+		return err
+	}
+	if got != want {
+		return errors.New("the download doesn't match its digest")
+	}
+	return nil
+}
+
+// fetch downloads the archive of key to dst, trying httpAttempts times.
+// With resume retries continue where the last attempt stopped, if the
+// server supports that. resumed tells if any did.
+func (r *httpRemote) fetch(key, dst string, resume bool) (resumed bool, err error) {
+	f, err := os.Create(dst)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	var n int64
+	var validator string
+	for attempt := 1; ; attempt++ {
+		header := http.Header{}
+		if n > 0 {
+			// If-Range makes the server send all of it if it changed
+			header.Set("Range", fmt.Sprintf("bytes=%d-", n))
+			header.Set("If-Range", validator)
+		}
+		var resp *http.Response
+		resp, err = r.do("GET", archiveName(key), nil, 0, header)
+		if errors.Is(err, ErrCacheMiss) {
+			return resumed, err
+		}
+		if err == nil {
+			total := resp.ContentLength
+			if start, size, ok := contentRange(resp); n > 0 && ok && start == n {
+				resumed = true
+				total = size
+			} else {
+				n = 0
+				err = f.Truncate(0)
+				if err == nil {
+					_, err = f.Seek(0, io.SeekStart)
+				}
+			}
+			validator = resp.Header.Get("ETag")
+			if validator == "" {
+				validator = resp.Header.Get("Last-Modified")
+			}
+			if err == nil {
+				var copied int64
+				copied, err = io.Copy(f, resp.Body)
+				n += copied
+			}
+			resp.Body.Close()
+			if err == nil && total >= 0 && n != total {
+				err = fmt.Errorf("got %d of %d bytes", n, total)
+			}
+			if err == nil {
+				return resumed, f.Close()
+			}
+		}
+		if attempt >= httpAttempts {
+			return resumed, err
+		}
+		// an error status rather than a dropped connection, e.g. for a
+		// range the server can't serve
+		var netErr *url.Error
+		badStatus := resp == nil && !errors.As(err, &netErr)
+		if !resume || validator == "" || badStatus {
+			n = 0
+		}
+		wait := retryBackoff << (attempt - 1)
+		Progressf("Download of %s interrupted (%v) - retrying in %v", key, err, wait)
+		time.Sleep(wait)
+	}
+}
+
+// contentRange returns the start and total size of the partial content in
+// resp. The size is -1 if the server didn't tell it.
+func contentRange(resp *http.Response) (start, size int64, ok bool) {
+	if resp.StatusCode != http.StatusPartialContent {
+		return 0, 0, false
+	}
+	var end int64
+	cr := resp.Header.Get("Content-Range")
+	if _, err := fmt.Sscanf(cr, "bytes %d-%d/%d", &start, &end, &size); err == nil {
+		return start, size, true
+	}
+	if _, err := fmt.Sscanf(cr, "bytes %d-%d/*", &start, &end); err == nil {
+		return start, -1, true
+	}
+	return 0, 0, false
+}
+
+func (r *httpRemote) Put(key, src string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	resp, err := r.do("PUT", archiveName(key), f, info.Size(), nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	sum, err := hashFile(src, sha256.New)
+	if err != nil {
+		return err
+	}
+	resp, err = r.do("PUT", archiveName(key)+".sha256", strings.NewReader(sum+"\n"), int64(len(sum)+1), nil)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// archiveName is the name the archive of key is stored as.
+func archiveName(key string) string {
+	return url.PathEscape(key) + ".tar.gz"
+}
+
+// do sends a request for the file name. Responses other than 2xx are
+// turned into errors, 404 into ErrCacheMiss.
+func (r *httpRemote) do(method, name string, body io.Reader, size int64, header http.Header) (*http.Response, error) {
+	u := r.base + "/" + name
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = size
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if r.token != "" {
+		req.Header.Set("Authorization", "Bearer "+r.token)
+	}
+
+	resp, err := remoteClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 == 2 {
+		return resp, nil
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrCacheMiss
+	}
+	return nil, fmt.Errorf("%s %s: %s", method, u, resp.Status)
+}
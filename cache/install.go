@@ -0,0 +1,347 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+)
+
+// InstallMode is how a cache entry is installed into the output directory.
+type InstallMode int
+
+const (
+	// InstallCopy copies the cached tree.
+	InstallCopy InstallMode = iota
+	// InstallSymlink makes the output a symlink to the cached tree.
+	InstallSymlink
+	// InstallHardlink recreates the directories of the cached tree and
+	// hardlinks the files. Tools can then modify the installed directories
+	// without touching the cache, while the file data is shared.
+	InstallHardlink
+)
+
+func (m InstallMode) String() string {
+	switch m {
+	case InstallSymlink:
+		return "symlink"
+	case InstallHardlink:
+		return "hardlink"
+	}
+	return "copy"
+}
+
+// InstallOptions control how cache entries are installed.
+type InstallOptions struct {
+	Mode InstallMode
+	// PreserveOwner copies file owners, which takes root.
+	PreserveOwner bool
+	// Merge installs over existing output dirs, see Merge. It can't be
+	// combined with InstallSymlink.
+	Merge bool
+	// RelativeSymlink makes InstallSymlink point to the entry relative to
+	// the output, so the link survives moving both to another path.
+	RelativeSymlink bool
+	// AutoStrategy copies instead of symlinking when the cache and the
+	// output are on different filesystems.
+	AutoStrategy bool
+	// Subpath, if set, installs only that subdir (slash separated) of each
+	// output in the entry. The entry itself stays complete.
+	Subpath string
+	// Rewrite is applied to the installed files matching RewriteFiles
+	// (patterns as for KeySpec.Exclude). It can't be combined with
+	// InstallSymlink.
+	Rewrite      []Rewrite
+	RewriteFiles []string
+	// ExtractCacheSize, if positive, installs archived entries from an
+	// extracted copy in the store, see extractedDir, keeping up to that
+	// many bytes of extracted trees.
+	ExtractCacheSize int64
+}
+
+// errMergeSymlink is returned when merging is asked for with InstallSymlink.
+var errMergeSymlink = errors.New("can't merge into an existing output dir and symlink it at the same time")
+
+// outputDir returns the dir the i'th output is kept in by an entry with
+// several outputs. Entries with a single output hold it directly.
+func outputDir(dir string, i int) string {
+	return filepath.Join(dir, strconv.Itoa(i))
+}
+
+// InstallEntry installs the cache entry dir to outputs and applies
+// opts.Rewrite to them. Missing parent dirs of outputs are created.
+func InstallEntry(dir string, outputs []string, opts InstallOptions) error {
+	if len(opts.Rewrite) > 0 && opts.Mode == InstallSymlink {
+		return errRewriteSymlink
+	}
+	err := installEntry(dir, outputs, opts)
+	if err != nil || len(opts.Rewrite) == 0 {
+		return err
+	}
+	for _, out := range outputs {
+		err := rewriteTree(out, opts.Rewrite, opts.RewriteFiles)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func installEntry(dir string, outputs []string, opts InstallOptions) error {
+	for _, out := range outputs {
+		err := os.MkdirAll(filepath.Dir(out), 0755)
+		if err != nil {
+			return err
+		}
+	}
+	if installSource(dir, opts) != dir {
+		var err error
+		dir, err = extracted(dir, opts.ExtractCacheSize)
+		if err != nil {
+			return err
+		}
+	}
+	if _, err := os.Stat(casPath(dir)); err == nil && len(outputs) > 1 {
+		for i, out := range outputs {
+			err := installCAS(dir, strconv.Itoa(i), out, opts)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if len(outputs) == 1 {
+		return Install(dir, outputs[0], opts)
+	}
+
+	if _, err := os.Stat(archivePath(dir)); err == nil {
+		// unpack it all next to the archive and move the outputs
+		// into place from there
+		tmp := tmpDir(dir)
+		err := extractArchiveFile(archivePath(dir), tmp)
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmp)
+		for i, out := range outputs {
+			src, err := subtree(outputDir(tmp, i), opts.Subpath)
+			if err != nil {
+				return err
+			}
+			if opts.Merge {
+				err = Merge(src, out, false, opts.PreserveOwner)
+			} else if err = os.Rename(src, out); err != nil {
+				err = copyExcluding(src, out, opts.PreserveOwner, nil)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for i, out := range outputs {
+		err := Install(outputDir(dir, i), out, opts)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Install installs the cache entry from to the output dir to, creating its
+// parent dirs if needed.
+func Install(from, to string, opts InstallOptions) (err error) {
+	if opts.Merge && opts.Mode == InstallSymlink {
+		return errMergeSymlink
+	}
+	from, err = filepath.Abs(from)
+	if err != nil {
+		return err
+	}
+	to, err = filepath.Abs(to)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(to), 0755)
+	if err != nil {
+		return err
+	}
+	same, known := sameDevice(filepath.Dir(from), filepath.Dir(to))
+	crossDevice := known && !same
+	defer func() {
+		if err != nil && crossDevice {
+			err = fmt.Errorf("cache %s and output %s are on different filesystems: %w", filepath.Dir(from), to, err)
+		}
+	}()
+
+	if _, err := os.Stat(casPath(from)); err == nil {
+		return installCAS(from, "", to, opts)
+	}
+	if _, err := os.Stat(archivePath(from)); err == nil && (opts.Merge || opts.Subpath != "") {
+		tmp := tmpDir(to)
+		err := extractArchiveFile(archivePath(from), tmp)
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmp)
+		src, err := subtree(tmp, opts.Subpath)
+		if err != nil {
+			return err
+		}
+		if opts.Merge {
+			return Merge(src, to, false, opts.PreserveOwner)
+		}
+		return os.Rename(src, to)
+	} else if err == nil {
+		return extractArchiveFile(archivePath(from), to)
+	}
+	from, err = subtree(from, opts.Subpath)
+	if err != nil {
+		return err
+	}
+
+	if opts.Merge {
+		err = Merge(from, to, opts.Mode == InstallHardlink, opts.PreserveOwner)
+		if isCrossDevice(err) {
+			Progress("Cache and output are on different filesystems - copying instead of hardlinking")
+			err = Merge(from, to, false, opts.PreserveOwner)
+		}
+		return err
+	}
+
+	switch opts.Mode {
+	case InstallSymlink:
+		if LinksTo(to, from) {
+			// left by an earlier run
+			return nil
+		}
+		if crossDevice && opts.AutoStrategy {
+			Progress("Cache and output are on different filesystems - copying instead of symlinking")
+			err = copyExcluding(from, to, opts.PreserveOwner, nil)
+			break
+		}
+		if crossDevice {
+			Progress("Cache and output are on different filesystems - some tools break on symlinks across them, see -auto-strategy")
+		}
+		// to is a symlink to from
+		target := from
+		if opts.RelativeSymlink {
+			target, err = filepath.Rel(filepath.Dir(to), from)
+			if err != nil {
+				return err
+			}
+		}
+		err = symlinkDir(target, to)
+	case InstallHardlink:
+		err = Hardlink(from, to, opts.PreserveOwner)
+	default:
+		err = copyExcluding(from, to, opts.PreserveOwner, nil)
+	}
+	return err
+}
+
+// installCAS materializes the part of the content addressed entry dir
+// below prefix, or opts.Subpath of that, at to. Only InstallCopy copies the
+// files, the other modes hardlink them.
+func installCAS(dir, prefix, to string, opts InstallOptions) error {
+	prefix = path.Join(prefix, opts.Subpath)
+	link := opts.Mode != InstallCopy
+	if !opts.Merge {
+		return materializeCAS(dir, prefix, to, link)
+	}
+	tmp := tmpDir(to)
+	defer os.RemoveAll(tmp)
+	err := materializeCAS(dir, prefix, tmp, link)
+	if err != nil {
+		return err
+	}
+	return Merge(tmp, to, link, opts.PreserveOwner)
+}
+
+// subtree returns the subdir sub (slash separated) of the installed tree
+// dir, failing if it has none. An empty sub is dir itself.
+func subtree(dir, sub string) (string, error) {
+	if sub == "" {
+		return dir, nil
+	}
+	p := filepath.Join(dir, filepath.FromSlash(sub))
+	if ok, err := IsDir(p); err != nil || !ok {
+		return "", fmt.Errorf("cache entry has no directory %s", sub)
+	}
+	return p, nil
+}
+
+// TrimOutput replaces the output dir out with its subdir sub, as Install
+// with Subpath sub would have installed it.
+func TrimOutput(out, sub string) error {
+	src := filepath.Join(out, filepath.FromSlash(sub))
+	if ok, err := IsDir(src); err != nil || !ok {
+		return fmt.Errorf("output %s has no directory %s", out, sub)
+	}
+	tmp := tmpDir(out)
+	err := os.Rename(src, tmp)
+	if err != nil {
+		return err
+	}
+	err = os.RemoveAll(out)
+	if err == nil {
+		err = os.Rename(tmp, out)
+	}
+	if err != nil {
+		os.RemoveAll(tmp)
+	}
+	return err
+}
+
+// LinksTo reports whether to is a symlink to from.
+func LinksTo(to, from string) bool {
+	target, err := os.Readlink(to)
+	if err != nil {
+		return false
+	}
+	if !filepath.IsAbs(target) {
+		target = filepath.Join(filepath.Dir(to), target)
+	}
+	target, err = filepath.Abs(target)
+	if err != nil {
+		return false
+	}
+	from, err = filepath.Abs(from)
+	if err != nil {
+		return false
+	}
+	return target == from
+}
+
+// Hardlink recreates the directories of the tree at a in b and hardlinks
+// all files. If a and b are on different filesystems the tree is copied
+// instead. With preserveOwner the owners of dirs and symlinks are copied,
+// files share theirs with the cache anyway.
+func Hardlink(a, b string, preserveOwner bool) error {
+	err := copyTree(a, b, copyOpts{link: true, preserveOwner: preserveOwner})
+	if err == nil {
+		return nil
+	}
+
+	errRm := os.RemoveAll(b)
+	if errRm != nil && !os.IsNotExist(errRm) {
+		return errRm
+	}
+	if !isCrossDevice(err) {
+		return err
+	}
+	Progress("Cache and output are on different filesystems - copying instead of hardlinking")
+	return copyExcluding(a, b, preserveOwner, nil)
+}
+
+func extractArchiveFile(archive, to string) error {
+	f, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return ExtractArchive(f, to)
+}
@@ -0,0 +1,255 @@
+package cache
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// keyFormat is bumped when what an entry holds changes incompatibly, giving
+// all entries new keys. At 0 keys are as they were before it existed.
+const keyFormat = 0
+
+// SaltEnv names the environment variable the salt is taken from when
+// -salt isn't given.
+const SaltEnv = "CACHE_PKGS_SALT"
+
+// KeySpec is everything that goes into a cache key.
+//
+// Without any of the optional parts the key is the plain hash of the
+// dependency descriptions as computed by hashFiles. Otherwise that hash and
+// each optional part is hashed once more to form the key.
+type KeySpec struct {
+	// Files are the dependency descriptions.
+	Files []string
+
+	// Cmd is the generation command and its args. Only set when the
+	// command should be part of the key (-key-includes-cmd).
+	Cmd []string
+
+	// Env are names of environment variables whose values are part of the
+	// key (-key-env). An unset variable hashes differently from an empty
+	// one.
+	Env []string
+
+	// Tools are the outputs of commands such as "python --version" which
+	// are part of the key (-key-tool), so entries built with another
+	// toolchain aren't reused. See RunKeyTools.
+	Tools []ToolOutput
+
+	// Outputs are the output dirs, only part of the key when there are
+	// several since the entry layout depends on them.
+	Outputs []string
+
+	// Normalize is how Files are normalized before hashing, see
+	// Normalize.
+	Normalize string
+
+	// FollowSymlinks hashes what symlinks in directories among Files point
+	// to rather than where they point, see hashDir.
+	FollowSymlinks bool
+
+	// NoFollowSpecs hashes Files which are symlinks by where they point,
+	// like symlinks in dirs, rather than by what they point to.
+	NoFollowSpecs bool
+
+	// Exclude are patterns of paths in the outputs which aren't cached.
+	// Part of the key since they change what is cached. A pattern without
+	// a slash matches a name at any depth, others the path from the
+	// output with "**" matching any number of dirs.
+	Exclude []string
+
+	// SpecCmd is a command whose output, SpecOutput, stands in for the
+	// dependency descriptions, e.g. "pip freeze". Files are then unused.
+	SpecCmd    []string
+	SpecOutput []byte
+
+	// Salt is mixed into the key, so caches sharing a store can be kept
+	// apart by giving each its own. It isolates, it doesn't protect: anyone
+	// who can read the store can use its entries regardless.
+	Salt string
+
+	// Version is mixed into the key, so bumping it invalidates all
+	// entries without removing them, e.g. when rolling out a new Exclude
+	// or Normalize policy. 0 leaves the key as without it.
+	Version int
+
+	// Label names one of several outputs generated from Files by commands
+	// of their own, each cached as an entry keyed by Files and its label.
+	Label string
+
+	// Key, if set, is used as the key as is and nothing is hashed, e.g.
+	// to install a known good entry while bisecting. The rest of the
+	// KeySpec is ignored then.
+	Key string
+
+	// fileNames are the names Files are hashed under when there are
+	// several, Files themselves if nil. See rekey.
+	fileNames []string
+}
+
+// extended reports whether the key has any optional parts.
+func (k KeySpec) extended() bool {
+	return len(k.Cmd) > 0 || len(k.Env) > 0 || len(k.Tools) > 0 || len(k.Outputs) > 1 || k.Normalize != "" || k.FollowSymlinks || k.NoFollowSpecs || len(k.Exclude) > 0 || k.Salt != "" ||
+		len(k.SpecCmd) > 0 || k.Label != "" || k.Version != 0 || keyFormat != 0
+}
+
+// specHash hashes the dependency descriptions, or the output of SpecCmd.
+func (k KeySpec) specHash(algo string, memo *hashMemo) (string, error) {
+	if len(k.SpecCmd) == 0 {
+		return hashFiles(k.Files, k.fileNames, algo, k.Normalize, k.FollowSymlinks, k.NoFollowSpecs, memo)
+	}
+	b := k.SpecOutput
+	if k.Normalize != "" {
+		var err error
+		b, err = normalizers[k.Normalize](b)
+		if err != nil {
+			return "", fmt.Errorf("normalizing the output of %q as %s: %w", k.SpecCmd, k.Normalize, err)
+		}
+	}
+	h := hashAlgos[algo]()
+	h.Write(b)
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+func (k KeySpec) hash(algo string, memo *hashMemo) (string, error) {
+	sum, err := k.specHash(algo, memo)
+	if err != nil || !k.extended() {
+		return sum, err
+	}
+
+	h := hashAlgos[algo]()
+	fmt.Fprintf(h, "files %s\n", sum)
+	if keyFormat != 0 {
+		fmt.Fprintf(h, "format %d\n", keyFormat)
+	}
+	if k.Version != 0 {
+		fmt.Fprintf(h, "version %d\n", k.Version)
+	}
+	if len(k.SpecCmd) > 0 {
+		fmt.Fprintf(h, "spec-cmd %q\n", k.SpecCmd)
+	}
+	if k.Normalize != "" {
+		fmt.Fprintf(h, "normalize %s\n", k.Normalize)
+	}
+	if k.FollowSymlinks {
+		fmt.Fprintln(h, "follow-symlinks")
+	}
+	if k.NoFollowSpecs {
+		fmt.Fprintln(h, "no-follow-specs")
+	}
+	if k.Salt != "" {
+		fmt.Fprintf(h, "salt %q\n", k.Salt)
+	}
+	if k.Label != "" {
+		fmt.Fprintf(h, "label %q\n", k.Label)
+	}
+	if len(k.Cmd) > 0 {
+		fmt.Fprintf(h, "cmd %q\n", k.Cmd)
+	}
+	if len(k.Outputs) > 1 {
+		fmt.Fprintf(h, "outputs %q\n", k.Outputs)
+	}
+	if len(k.Exclude) > 0 {
+		exclude := append([]string(nil), k.Exclude...)
+		sort.Strings(exclude)
+		fmt.Fprintf(h, "exclude %q\n", exclude)
+	}
+	env := append([]string(nil), k.Env...)
+	sort.Strings(env)
+	for _, name := range env {
+		if v, ok := os.LookupEnv(name); ok {
+			fmt.Fprintf(h, "env %s=%q\n", name, v)
+		} else {
+			fmt.Fprintf(h, "env %s unset\n", name)
+		}
+	}
+	tools := append([]ToolOutput(nil), k.Tools...)
+	sort.Slice(tools, func(i, j int) bool {
+		return strings.Join(tools[i].Cmd, " ") < strings.Join(tools[j].Cmd, " ")
+	})
+	for _, t := range tools {
+		fmt.Fprintf(h, "tool %q %q\n", t.Cmd, t.Output)
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// Keys returns the keys the cache entry for k may be stored under when
+// hashing with algo. The first key is where new entries are written,
+// the rest are legacy keys which are still honored on lookup.
+//
+// Keys are prefixed with the algorithm name (e.g. "sha256-<hex>") so that
+// entries from different algorithms never get mistaken for each other.
+// sha1 keys are left unprefixed to stay compatible with existing caches.
+func (k KeySpec) Keys(algo string) ([]string, error) {
+	return k.keys(algo, nil)
+}
+
+// keys is Keys, looking up the hashes of unchanged Files in memo if it
+// isn't nil.
+func (k KeySpec) keys(algo string, memo *hashMemo) ([]string, error) {
+	if k.Key != "" {
+		if !validKey(k.Key) {
+			return nil, fmt.Errorf("bad key %q", k.Key)
+		}
+		return []string{k.Key}, nil
+	}
+	if _, ok := hashAlgos[algo]; !ok {
+		return nil, fmt.Errorf("unknown hash algorithm %q (use one of %s)", algo, HashAlgoNames())
+	}
+	if _, ok := normalizers[k.Normalize]; !ok && k.Normalize != "" {
+		return nil, fmt.Errorf("unknown normalization %q (use %s or %s)", k.Normalize, NormalizeJSON, NormalizeWhitespace)
+	}
+
+	for _, fname := range k.Files {
+		err := checkSpec(fname, k.NoFollowSpecs)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	h, err := k.hash(algo, memo)
+	if err != nil {
+		return nil, err
+	}
+	if algo == legacyAlgo {
+		return []string{h}, nil
+	}
+	if k.extended() {
+		// legacy entries never had anything but the files in their key
+		return []string{algo + "-" + h}, nil
+	}
+
+	legacy, err := k.hash(legacyAlgo, memo)
+	if err != nil {
+		return nil, err
+	}
+	return []string{algo + "-" + h, legacy}, nil
+}
+
+// checkSpec fails if the dependency description fname is missing. A
+// symlink must point to something readable, unless noFollow hashes it as a
+// link, and the error then names its target: a link into another checkout
+// may well dangle.
+func checkSpec(fname string, noFollow bool) error {
+	info, err := os.Lstat(fname)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("dependency description %q does not exist", fname)
+	}
+	if err != nil || info.Mode()&os.ModeSymlink == 0 || noFollow {
+		return err
+	}
+	target, err := os.Readlink(fname)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(fname)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("dependency description %q is a broken symlink -> %s", fname, target)
+	}
+	if err != nil {
+		return fmt.Errorf("dependency description %q is a symlink -> %s which can't be read: %w", fname, target, err)
+	}
+	return f.Close()
+}
@@ -0,0 +1,55 @@
+package cache
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Materialize replaces out, a symlink to an installed cache entry, with a
+// copy of the tree it links to, for installing lazily: symlink right away
+// and copy later. The copy is made next to out and swapped in only if out
+// still links to the same tree by then. If anything fails out is left the
+// symlink it was.
+//
+// A dir can't be renamed over a symlink, so the swap is two renames right
+// after each other: for that instant out doesn't exist.
+func Materialize(out string) error {
+	info, err := os.Lstat(out)
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSymlink == 0 {
+		return fmt.Errorf("%s is not a symlink", out)
+	}
+	target, err := filepath.EvalSymlinks(out)
+	if err != nil {
+		return err
+	}
+
+	tmp := tmpDir(out)
+	os.RemoveAll(tmp)
+	err = Copy(target, tmp)
+	if err != nil {
+		os.RemoveAll(tmp)
+		return fmt.Errorf("copying %s: %w", target, err)
+	}
+	if now, err := filepath.EvalSymlinks(out); err != nil || now != target {
+		os.RemoveAll(tmp)
+		return fmt.Errorf("%s changed while it was copied", out)
+	}
+
+	link := tmp + ".link"
+	err = os.Rename(out, link)
+	if err == nil {
+		err = os.Rename(tmp, out)
+		if err != nil {
+			os.Rename(link, out)
+		}
+	}
+	if err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+	return os.Remove(link)
+}
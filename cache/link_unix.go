@@ -0,0 +1,11 @@
+//go:build !windows
+
+package cache
+
+import "os"
+
+// symlinkDir makes to a symlink to the directory target, which may be
+// relative to the directory of to.
+func symlinkDir(target, to string) error {
+	return os.Symlink(target, to)
+}
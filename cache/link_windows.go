@@ -0,0 +1,34 @@
+//go:build windows
+
+package cache
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// symlinkDir makes to a symlink to the directory target, which may be
+// relative to the directory of to. Creating symlinks needs special
+// privileges on Windows, so when that fails a directory junction is tried
+// and as a last resort target is copied. Junctions are always absolute.
+func symlinkDir(target, to string) error {
+	err := os.Symlink(target, to)
+	if err == nil {
+		return nil
+	}
+	Progress("Can't symlink, trying a directory junction: ", err)
+
+	from := target
+	if !filepath.IsAbs(from) {
+		from = filepath.Join(filepath.Dir(to), from)
+	}
+
+	err = exec.Command("cmd", "/c", "mklink", "/J", to, from).Run()
+	if err == nil {
+		return nil
+	}
+	Progress("Can't create junction, copying instead: ", err)
+
+	return Copy(from, to)
+}
@@ -0,0 +1,107 @@
+package cache
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const timeFormat = "2006-01-02 15:04"
+
+// List writes the entries in cacheStore and its namespaces to w, either as
+// columns or, with asJSON, as JSON, see SchemaVersion. Entries are grouped by
+// namespace. With since only those created or used within that long are
+// listed, most recent first.
+func List(w io.Writer, cacheStore string, since time.Duration, asJSON bool) error {
+	entries, err := Entries(cacheStore)
+	if err != nil {
+		return err
+	}
+	namespaces, err := Namespaces(cacheStore)
+	if err != nil {
+		return err
+	}
+	for _, ns := range namespaces {
+		nsEntries, err := Entries(filepath.Join(cacheStore, ns))
+		if err != nil {
+			return err
+		}
+		for i := range nsEntries {
+			nsEntries[i].Namespace = ns
+		}
+		entries = append(entries, nsEntries...)
+	}
+	if since > 0 {
+		entries = recent(entries, time.Now().Add(-since))
+	} else {
+		sort.Slice(entries, func(i, j int) bool {
+			if entries[i].Namespace != entries[j].Namespace {
+				return entries[i].Namespace < entries[j].Namespace
+			}
+			return entries[i].Key < entries[j].Key
+		})
+	}
+	err = EntrySizes(entries)
+	if err != nil {
+		return err
+	}
+
+	if asJSON {
+		if entries == nil {
+			entries = []Entry{}
+		}
+		return writeJSON(w, struct {
+			SchemaVersion int     `json:"schemaVersion"`
+			Entries       []Entry `json:"entries"`
+		}{SchemaVersion, entries})
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "KEY\tSIZE\tCREATED\tLAST USED\tPINNED\tSPEC\tCOMMAND")
+	for _, e := range entries {
+		spec, cmd := "-", "-"
+		if e.Manifest != nil {
+			spec, cmd = strings.Join(e.Manifest.Spec, ","), strings.Join(e.Manifest.Cmd, " ")
+			if len(e.Manifest.SpecCmd) > 0 {
+				spec = "`" + strings.Join(e.Manifest.SpecCmd, " ") + "`"
+			}
+		}
+		key := e.Key
+		if e.Namespace != "" {
+			key = e.Namespace + "/" + key
+		}
+		pinned := "-"
+		if e.Pinned {
+			pinned = "yes"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", key, FormatSize(e.Size), e.Created.Format(timeFormat), e.LastUsed.Format(timeFormat), pinned, spec, cmd)
+	}
+	return tw.Flush()
+}
+
+// recent returns the entries created or used after cutoff, most recent
+// first.
+func recent(entries []Entry, cutoff time.Time) []Entry {
+	var r []Entry
+	for _, e := range entries {
+		if lastTouched(e).After(cutoff) {
+			r = append(r, e)
+		}
+	}
+	sort.SliceStable(r, func(i, j int) bool {
+		return lastTouched(r[i]).After(lastTouched(r[j]))
+	})
+	return r
+}
+
+// lastTouched is the later of when e was created and last used.
+func lastTouched(e Entry) time.Time {
+	if e.LastUsed.After(e.Created) {
+		return e.LastUsed
+	}
+	return e.Created
+}
@@ -0,0 +1,120 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+var (
+	// ErrLocked is returned by TryLockEntry when someone else holds the
+	// lock.
+	ErrLocked = errors.New("locked")
+	// ErrLockTimeout is wrapped by the error of LockEntry when it gave up
+	// waiting for the lock.
+	ErrLockTimeout = errors.New("timed out")
+)
+
+// Lock is an exclusive lock on a cache entry, held while it is generated.
+type Lock struct {
+	f *os.File
+}
+
+func lockPath(dir string) string {
+	return dir + ".lock"
+}
+
+// LockEntry takes the lock for the cache entry dir, waiting for other
+// processes to release it. It gives up after timeout unless timeout is 0.
+//
+// The lock file records the host and pid of the holder, for the wait
+// message. A holder which dies releases the lock with it, so there is no
+// stale lock to reclaim.
+func LockEntry(dir string, timeout time.Duration) (*Lock, error) {
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+
+	waiting := false
+	for {
+		l, err := TryLockEntry(dir)
+		if err != ErrLocked {
+			return l, err
+		}
+
+		holder := lockHolder(dir)
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			return nil, fmt.Errorf("%w after %v waiting for lock %s held by %s", ErrLockTimeout, timeout, lockPath(dir), holder)
+		}
+		if !waiting {
+			Progressf("Waiting for %s to finish generating", holder)
+			waiting = true
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// TryLockEntry takes the lock for the cache entry dir if it is free.
+// Otherwise ErrLocked is returned.
+func TryLockEntry(dir string) (*Lock, error) {
+	p := lockPath(dir)
+	// left to the umask, the lock must be writable by whoever shares the
+	// store
+	f, err := os.OpenFile(p, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tryLock(f)
+	if err == nil {
+		// the file might have been removed along with its entry, in
+		// which case we locked a file no one else will look at
+		var fi, pi os.FileInfo
+		fi, err = f.Stat()
+		if err == nil {
+			pi, err = os.Stat(p)
+		}
+		if err == nil && !os.SameFile(fi, pi) {
+			err = ErrLocked
+		}
+	}
+	if err == nil {
+		host, _ := os.Hostname()
+		err = f.Truncate(0)
+		if err == nil {
+			_, err = fmt.Fprintf(f, "%s %d", host, os.Getpid())
+		}
+	}
+	if err != nil {
+		f.Close()
+		if os.IsNotExist(err) {
+			err = ErrLocked
+		}
+		return nil, err
+	}
+	return &Lock{f: f}, nil
+}
+
+// Unlock releases the lock.
+func (l *Lock) Unlock() error {
+	// the lock file stays, removing it would race with others locking it
+	return l.f.Close()
+}
+
+// lockHolder returns the "host pid" of the process holding the lock for
+// dir as recorded in the lock file.
+func lockHolder(dir string) string {
+	f, err := os.Open(lockPath(dir))
+	if err != nil {
+		return "unknown process"
+	}
+	defer f.Close()
+	b, err := io.ReadAll(io.LimitReader(f, 1024))
+	if err != nil || len(b) == 0 {
+		return "unknown process"
+	}
+	return string(b)
+}
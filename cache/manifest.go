@@ -0,0 +1,168 @@
+package cache
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Version is the version of cache-pkgs recorded in manifests. Set it with
+// -ldflags "-X github.com/stengaard/cache-pkgs/cache.Version=...".
+var Version = "dev"
+
+// Manifest records how a cache entry was produced. It is stored next to
+// the entry dir, so it isn't installed along with it.
+type Manifest struct {
+	// Spec are the absolute paths of the dependency descriptions.
+	Spec []string `json:"spec"`
+	// SpecCmd is the command whose output was hashed instead, if any.
+	SpecCmd []string `json:"specCmd,omitempty"`
+	// Hash is the algorithm the key was computed with.
+	Hash string   `json:"hash"`
+	Cmd  []string `json:"cmd"`
+	// Outputs are the absolute paths of the output dirs.
+	Outputs []string `json:"outputs,omitempty"`
+	// SpecNames and OutputNames are Spec and Outputs as given, which the
+	// key hashes the names of when there are several. Only recorded then.
+	SpecNames   []string `json:"specNames,omitempty"`
+	OutputNames []string `json:"outputNames,omitempty"`
+	// Exclude are the patterns of paths left out of the cached tree.
+	Exclude []string  `json:"exclude,omitempty"`
+	Version string    `json:"version"`
+	Created time.Time `json:"created"`
+	// BuildMS is how long the command took to generate the entry.
+	BuildMS int64 `json:"build_ms,omitempty"`
+	// Source is the remote the entry was fetched from, if any.
+	Source string `json:"source,omitempty"`
+	// Digest is the hashDir digest of the cached tree, or the hash of its
+	// archive. Only recorded with -verify.
+	Digest string `json:"digest,omitempty"`
+	// Pinned entries are kept by eviction and expiry, see Cache.Pin.
+	Pinned bool `json:"pinned,omitempty"`
+}
+
+func manifestPath(dir string) string {
+	return dir + ".json"
+}
+
+// NewManifest returns a manifest for an entry keyed off the dependency
+// descriptions spec and hashed with algo.
+func NewManifest(spec []string, algo string) *Manifest {
+	return &Manifest{Spec: absPaths(spec), Hash: algo, Version: Version}
+}
+
+// keyManifest returns a manifest for an entry keyed off k with algo,
+// recording what MigrateHash needs to rekey it.
+func keyManifest(k KeySpec, algo string) *Manifest {
+	m := NewManifest(k.Files, algo)
+	m.SpecCmd = k.SpecCmd
+	m.Exclude = k.Exclude
+	if len(k.Files) > 1 {
+		m.SpecNames = k.Files
+	}
+	if len(k.Outputs) > 1 {
+		m.OutputNames = k.Outputs
+	}
+	return m
+}
+
+func absPaths(paths []string) []string {
+	var abs []string
+	for _, p := range paths {
+		a, err := filepath.Abs(p)
+		if err == nil {
+			p = a
+		}
+		abs = append(abs, p)
+	}
+	return abs
+}
+
+// lastBuild returns how long the command took for the most recent entry in
+// cacheStore generated to outputs, if any. Reading the manifests, failures
+// just mean there is nothing to go by.
+func lastBuild(cacheStore string, outputs []string) (d time.Duration, ok bool) {
+	entries, _ := Entries(cacheStore)
+	want := strings.Join(absPaths(outputs), "\x00")
+	var latest time.Time
+	for _, e := range entries {
+		m := e.Manifest
+		if m == nil || m.BuildMS == 0 || strings.Join(m.Outputs, "\x00") != want {
+			continue
+		}
+		if m.Created.After(latest) {
+			latest, d, ok = m.Created, time.Duration(m.BuildMS)*time.Millisecond, true
+		}
+	}
+	return d, ok
+}
+
+// WriteManifest stores m for the cache entry dir.
+func WriteManifest(dir string, m *Manifest) error {
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	p := manifestPath(dir)
+	tmp := tmpDir(p)
+	err = os.WriteFile(tmp, append(b, '\n'), 0644)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp, p)
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// ReadManifest returns the manifest of the cache entry dir. Entries cached
+// before manifests existed have none, in which case it returns nil.
+func ReadManifest(dir string) (*Manifest, error) {
+	b, err := os.ReadFile(manifestPath(dir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	m := &Manifest{}
+	err = json.Unmarshal(b, m)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Verify checks the tree of the cache entry dir against the digest
+// recorded in its manifest. Entries without a digest are assumed to be
+// intact.
+func Verify(dir string) (ok bool, err error) {
+	m, err := ReadManifest(dir)
+	if err != nil {
+		return false, err
+	}
+	if m == nil || m.Digest == "" {
+		Progress("No digest recorded for the cached dependencies - skipping verification")
+		return true, nil
+	}
+	newHash, ok := hashAlgos[m.Hash]
+	if !ok {
+		return false, fmt.Errorf("manifest has unknown hash algorithm %q", m.Hash)
+	}
+
+	p := dir
+	for _, q := range []string{archivePath(dir), casPath(dir)} {
+		if _, err := os.Stat(q); err == nil {
+			p = q
+		}
+	}
+	digest, err := hashFile(p, newHash)
+	if err != nil {
+		return false, err
+	}
+	return digest == m.Digest, nil
+}
@@ -0,0 +1,107 @@
+package cache
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// hashMemoFile is where the hashes of spec files are remembered in the store.
+const hashMemoFile = "hashes.json"
+
+// racyWindow is how recently a file may have been modified for its hash
+// not to be remembered: another write within the resolution of its
+// modification time would go unnoticed.
+const racyWindow = 2 * time.Second
+
+// hashMemo remembers the hashes of files by their size and modification
+// time, so unchanged files need not be read again. All methods are no-ops
+// on a nil *hashMemo.
+type hashMemo struct {
+	path    string
+	entries map[string]memoEntry
+	dirty   bool
+}
+
+type memoEntry struct {
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"mtime"`
+	Sum     string `json:"sum"`
+}
+
+// loadHashMemo reads the memo in cacheStore. A missing or unreadable memo
+// is just empty.
+func loadHashMemo(cacheStore string) *hashMemo {
+	m := &hashMemo{path: filepath.Join(cacheStore, hashMemoFile), entries: map[string]memoEntry{}}
+	b, err := os.ReadFile(m.path)
+	if err == nil && json.Unmarshal(b, &m.entries) != nil {
+		m.entries = map[string]memoEntry{}
+	}
+	return m
+}
+
+func memoKey(fname, algo, normalize string) string {
+	abs, err := filepath.Abs(fname)
+	if err != nil {
+		abs = fname
+	}
+	return algo + " " + normalize + " " + abs
+}
+
+func (m *hashMemo) get(fname string, info os.FileInfo, algo, normalize string) (string, bool) {
+	if m == nil {
+		return "", false
+	}
+	e, ok := m.entries[memoKey(fname, algo, normalize)]
+	if !ok || e.Size != info.Size() || e.ModTime != info.ModTime().UnixNano() {
+		return "", false
+	}
+	return e.Sum, true
+}
+
+func (m *hashMemo) put(fname string, info os.FileInfo, algo, normalize, sum string) {
+	if m == nil || time.Since(info.ModTime()) < racyWindow {
+		return
+	}
+	m.entries[memoKey(fname, algo, normalize)] = memoEntry{Size: info.Size(), ModTime: info.ModTime().UnixNano(), Sum: sum}
+	m.dirty = true
+}
+
+// save writes the memo back if it changed. Concurrent runs may overwrite
+// each other's additions, which only costs a rehash.
+func (m *hashMemo) save() error {
+	if m == nil || !m.dirty {
+		return nil
+	}
+	b, err := json.Marshal(m.entries)
+	if err != nil {
+		return err
+	}
+	tmp := tmpDir(m.path)
+	err = os.WriteFile(tmp, b, 0644)
+	if err == nil {
+		err = os.Rename(tmp, m.path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// keys returns the keys for k, using the memo of the store unless
+// MtimeShortcut is off.
+func (c *Cache) keys(k KeySpec) ([]string, error) {
+	if !c.MtimeShortcut {
+		return k.Keys(c.Hash)
+	}
+	memo := loadHashMemo(c.NamespaceDir())
+	keys, err := k.keys(c.Hash, memo)
+	if err != nil || c.ReadOnly {
+		return keys, err
+	}
+	if err := memo.save(); err != nil {
+		Progress("Can't remember the hashes of the dependency descriptions: ", err)
+	}
+	return keys, nil
+}
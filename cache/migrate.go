@@ -0,0 +1,164 @@
+package cache
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// MigrateHash rekeys the entries in cacheStore keyed with another hash
+// algorithm than algo, so they are hit again after switching to it. That
+// takes the dependency descriptions recorded in the manifest to still hash
+// to the entry's key. Entries it can't rekey, such as those whose
+// descriptions changed or were keyed with -key-env or by a -spec-cmd, are
+// returned as orphans: nothing will hit them any more. With prune they are
+// removed. With dryRun nothing is changed, only reported.
+func MigrateHash(cacheStore, algo string, prune, dryRun bool) (migrated int, orphans []Entry, err error) {
+	if _, ok := hashAlgos[algo]; !ok {
+		return 0, nil, fmt.Errorf("unknown hash algorithm %q (use one of %s)", algo, HashAlgoNames())
+	}
+	entries, err := Entries(cacheStore)
+	if err != nil {
+		return 0, nil, err
+	}
+	verb := "Migrated"
+	if dryRun {
+		verb = "Would migrate"
+	}
+	for _, e := range entries {
+		if keyAlgo(e.Key) == algo {
+			continue
+		}
+		newKey, ok := rekey(e, algo)
+		if !ok {
+			orphans = append(orphans, e)
+			continue
+		}
+		newDir := filepath.Join(cacheStore, newKey)
+		if ok, err := EntryExists(newDir); err != nil || ok {
+			if err != nil {
+				return migrated, orphans, err
+			}
+			// cached again under algo meanwhile
+			orphans = append(orphans, e)
+			continue
+		}
+		if !dryRun {
+			moved, err := moveEntry(e, newDir, algo)
+			if err != nil {
+				return migrated, orphans, err
+			}
+			if !moved {
+				Progressf("Skipping %s, it is in use", e.Key)
+				continue
+			}
+			// like RemoveEntry does
+			os.Remove(lockPath(e.Dir))
+		}
+		Progressf("%s %s to %s", verb, e.Key, newKey)
+		migrated++
+	}
+
+	for _, e := range orphans {
+		switch {
+		case !prune:
+			Progressf("Orphaned %s (cached %s)", e.Key, e.Created.Format(timeFormat))
+		case dryRun:
+			Progressf("Would remove orphaned %s", e.Key)
+		default:
+			removed, err := removeUnlocked(e)
+			if err != nil {
+				return migrated, orphans, err
+			}
+			if removed {
+				Progressf("Removed orphaned %s", e.Key)
+			}
+		}
+	}
+	if prune && !dryRun {
+		err = PruneBlobs(cacheStore)
+	}
+	return migrated, orphans, err
+}
+
+// rekey returns the key of e under algo, if what its manifest records
+// still hashes to its current key. The files are read from their absolute
+// paths but hashed under the names given, as the key was. Whether the
+// command was part of the key isn't recorded, so both are tried.
+func rekey(e Entry, algo string) (string, bool) {
+	m := e.Manifest
+	if m == nil || len(m.SpecCmd) > 0 || len(m.Spec) == 0 {
+		return "", false
+	}
+	old := keyAlgo(e.Key)
+	base := KeySpec{Files: m.Spec, fileNames: m.SpecNames, Exclude: m.Exclude, Outputs: m.Outputs}
+	if len(m.SpecNames) != len(m.Spec) {
+		// recorded before the names were
+		base.fileNames = nil
+	}
+	if len(m.OutputNames) > 0 {
+		base.Outputs = m.OutputNames
+	}
+	withCmd := base
+	withCmd.Cmd = m.Cmd
+	for _, k := range []KeySpec{base, withCmd} {
+		keys, err := k.Keys(old)
+		if err != nil {
+			// the descriptions are gone
+			return "", false
+		}
+		if keys[0] != e.Key {
+			continue
+		}
+		keys, err = k.Keys(algo)
+		if err != nil {
+			return "", false
+		}
+		return keys[0], true
+	}
+	return "", false
+}
+
+// moveEntry renames e and everything recorded about it to newDir, keyed
+// with algo, unless e is locked by a run using it.
+func moveEntry(e Entry, newDir, algo string) (moved bool, err error) {
+	l, err := TryLockEntry(e.Dir)
+	if err == ErrLocked {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer l.Unlock()
+
+	err = removeExtracted(extractedPath(e.Dir))
+	if err != nil {
+		return false, err
+	}
+	for _, p := range []func(string) string{archivePath, casPath, manifestPath, usedPath} {
+		err := os.Rename(p(e.Dir), p(newDir))
+		if err != nil && !os.IsNotExist(err) {
+			return false, err
+		}
+	}
+	err = os.Rename(e.Dir, newDir)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+
+	m := e.Manifest
+	m.Hash = algo
+	if m.Digest != "" {
+		p := newDir
+		for _, q := range []string{archivePath(newDir), casPath(newDir)} {
+			if _, err := os.Stat(q); err == nil {
+				p = q
+			}
+		}
+		m.Digest, err = hashFile(p, hashAlgos[algo])
+		if err != nil {
+			return false, err
+		}
+	}
+	return true, WriteManifest(newDir, m)
+}
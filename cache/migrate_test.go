@@ -0,0 +1,57 @@
+package cache
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// TestMigrateHashNames rekeys entries whose keys hash the names of
+// several specs or outputs, given relative to the working dir.
+func TestMigrateHashNames(t *testing.T) {
+	c, _, dir := testCache(t, InstallSymlink)
+	t.Chdir(dir)
+	for _, spec := range []string{"a.json", "b.json"} {
+		err := writeFile(filepath.Join(dir, spec), spec, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	specs := KeySpec{Files: []string{"a.json", "b.json"}}
+	outs := KeySpec{Files: []string{"a.json"}, Outputs: []string{"o3", "o4"}}
+	run := func() (hits int) {
+		t.Helper()
+		for _, tc := range []struct {
+			k       KeySpec
+			outputs []string
+			cmd     []string
+		}{
+			{specs, []string{"o1"}, helperCmd(t, "write", "o1", "f")},
+			{outs, outs.Outputs, helperCmd(t, "write", ".", "o3/f", "o4/f")},
+		} {
+			hit, err := c.EnsureInstalled(tc.k, tc.outputs, tc.cmd)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if hit {
+				hits++
+			}
+		}
+		return hits
+	}
+	if run() != 0 {
+		t.Fatal("the first runs hit")
+	}
+
+	migrated, orphans, err := MigrateHash(c.NamespaceDir(), "sha512", true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if migrated != 2 || len(orphans) != 0 {
+		t.Fatalf("migrated %d, orphaned %v, want both migrated", migrated, orphans)
+	}
+	c.Hash = "sha512"
+	c.Force = true
+	if hits := run(); hits != 2 {
+		t.Errorf("%d of 2 runs hit after migrating", hits)
+	}
+}
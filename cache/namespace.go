@@ -0,0 +1,80 @@
+package cache
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// NamespaceDir returns the dir the entries of c's Namespace are kept in,
+// Dir itself without one.
+func (c *Cache) NamespaceDir() string {
+	return filepath.Join(c.Dir, c.Namespace)
+}
+
+// remoteKey returns the key the cache entry dir has on the remote, which is
+// prefixed by the namespace.
+func (c *Cache) remoteKey(dir string) string {
+	return path.Join(c.Namespace, filepath.Base(dir))
+}
+
+// ValidNamespace checks that ns can name a namespace, a subdir of the store
+// which can't be mistaken for an entry.
+func ValidNamespace(ns string) error {
+	valid := ns != "" && !isKeyName(ns) && ns != blobsDir && ns != extractedDir && !strings.HasPrefix(ns, ".")
+	for _, r := range ns {
+		valid = valid && (r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-_.", r))
+	}
+	if !valid || strings.Contains(ns, tmpMarker) {
+		return fmt.Errorf("bad namespace %q: use letters, digits, '-', '_' and '.' and don't make it look like a key", ns)
+	}
+	return nil
+}
+
+// isKeyName reports whether name is formed like a key, hex digits with an
+// optional hash algorithm prefix.
+func isKeyName(name string) bool {
+	if algo := keyAlgo(name); strings.HasPrefix(name, algo+"-") {
+		name = name[len(algo)+1:]
+	}
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		if !strings.ContainsRune("0123456789abcdef", r) {
+			return false
+		}
+	}
+	return true
+}
+
+// Namespaces returns the namespaces in cacheStore.
+func Namespaces(cacheStore string) ([]string, error) {
+	dirs, err := os.ReadDir(cacheStore)
+	if err != nil {
+		return nil, err
+	}
+	var namespaces []string
+	for _, d := range dirs {
+		if d.IsDir() && isNamespace(filepath.Join(cacheStore, d.Name())) {
+			namespaces = append(namespaces, d.Name())
+		}
+	}
+	return namespaces, nil
+}
+
+// isNamespace reports whether the dir d in a store is a namespace rather
+// than an entry, which always has a manifest or usage record.
+func isNamespace(d string) bool {
+	if ValidNamespace(filepath.Base(d)) != nil {
+		return false
+	}
+	for _, p := range []string{manifestPath(d), usedPath(d)} {
+		if _, err := os.Stat(p); err == nil {
+			return false
+		}
+	}
+	return true
+}
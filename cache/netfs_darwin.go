@@ -0,0 +1,34 @@
+//go:build darwin
+
+package cache
+
+import "syscall"
+
+var networkFSTypes = map[string]bool{
+	"nfs":    true,
+	"smbfs":  true,
+	"afpfs":  true,
+	"webdav": true,
+	"cifs":   true,
+}
+
+// networkFS returns the name of the network filesystem p is on, or "" if
+// it's local.
+func networkFS(p string) (string, error) {
+	var st syscall.Statfs_t
+	err := syscall.Statfs(p, &st)
+	if err != nil {
+		return "", err
+	}
+	var name []byte
+	for _, c := range st.Fstypename {
+		if c == 0 {
+			break
+		}
+		name = append(name, byte(c))
+	}
+	if !networkFSTypes[string(name)] {
+		return "", nil
+	}
+	return string(name), nil
+}
@@ -0,0 +1,30 @@
+//go:build linux
+
+package cache
+
+import "syscall"
+
+// networkFSTypes are the statfs magic numbers of network filesystems.
+var networkFSTypes = map[uint32]string{
+	0x6969:     "nfs",
+	0x517b:     "smb",
+	0xff534d42: "cifs",
+	0xfe534d42: "smb2",
+	0x73757245: "coda",
+	0x5346414f: "afs",
+	0x00c36400: "ceph",
+	0x01021997: "9p",
+	0x0bd00bd0: "lustre",
+	0x564c:     "ncp",
+}
+
+// networkFS returns the name of the network filesystem p is on, or "" if
+// it's local.
+func networkFS(p string) (string, error) {
+	var st syscall.Statfs_t
+	err := syscall.Statfs(p, &st)
+	if err != nil {
+		return "", err
+	}
+	return networkFSTypes[uint32(st.Type)], nil
+}
@@ -0,0 +1,31 @@
+//go:build windows
+
+package cache
+
+import (
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/windows"
+)
+
+// networkFS returns "network share" if p is a UNC path, "network drive" if
+// it is on a mapped network drive and "" if it's local.
+func networkFS(p string) (string, error) {
+	p, err := filepath.Abs(p)
+	if err != nil {
+		return "", err
+	}
+	vol := filepath.VolumeName(p)
+	if strings.HasPrefix(vol, `\\`) {
+		return "network share", nil
+	}
+	root, err := windows.UTF16PtrFromString(vol + `\`)
+	if err != nil {
+		return "", err
+	}
+	if windows.GetDriveType(root) == windows.DRIVE_REMOTE {
+		return "network drive", nil
+	}
+	return "", nil
+}
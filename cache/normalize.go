@@ -0,0 +1,102 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Ways of normalizing dependency descriptions before hashing, so
+// differences that don't change the dependencies keep the key.
+const (
+	// NormalizeJSON hashes JSON files canonically encoded, with sorted
+	// object keys and no insignificant whitespace.
+	NormalizeJSON = "json"
+	// NormalizeWhitespace strips trailing whitespace from every line,
+	// drops trailing blank lines and turns CRLF into LF.
+	NormalizeWhitespace = "whitespace"
+)
+
+var normalizers = map[string]func([]byte) ([]byte, error){
+	NormalizeJSON:       normalizeJSON,
+	NormalizeWhitespace: normalizeWhitespace,
+}
+
+func normalizeJSON(b []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	// keep numbers exactly as written rather than round them to float64
+	dec.UseNumber()
+	var v interface{}
+	err := dec.Decode(&v)
+	if err != nil {
+		return nil, err
+	}
+	if dec.More() {
+		return nil, fmt.Errorf("trailing data after the JSON value")
+	}
+	// maps are marshaled with sorted keys
+	return json.Marshal(v)
+}
+
+func normalizeWhitespace(b []byte) ([]byte, error) {
+	lines := bytes.Split(b, []byte("\n"))
+	for i, l := range lines {
+		lines[i] = bytes.TrimRight(l, " \t\r")
+	}
+	for len(lines) > 0 && len(lines[len(lines)-1]) == 0 {
+		lines = lines[:len(lines)-1]
+	}
+	return bytes.Join(lines, []byte("\n")), nil
+}
+
+// hashSpec hashes the dependency description fname with algo, normalized
+// as given by normalize. Directories are hashed as is, following symlinks
+// if follow is set, see hashDir. With noFollow a symlink fname is hashed
+// by its target as in hashDir. memo, if not nil, is consulted and updated
+// for files.
+func hashSpec(fname, algo, normalize string, follow, noFollow bool, memo *hashMemo) (sum string, err error) {
+	newHash := hashAlgos[algo]
+	if noFollow {
+		if info, err := os.Lstat(fname); err == nil && info.Mode()&os.ModeSymlink != 0 {
+			target, err := os.Readlink(fname)
+			if err != nil {
+				return "", err
+			}
+			h := newHash()
+			io.WriteString(h, target)
+			return fmt.Sprintf("%x", h.Sum(nil)), nil
+		}
+	}
+	info, err := os.Stat(fname)
+	if err != nil {
+		return "", err
+	}
+	if info.IsDir() {
+		return hashPath(fname, newHash, follow)
+	}
+	if sum, ok := memo.get(fname, info, algo, normalize); ok {
+		return sum, nil
+	}
+	defer func() {
+		if err == nil {
+			memo.put(fname, info, algo, normalize, sum)
+		}
+	}()
+	if normalize == "" {
+		return hashFile(fname, newHash)
+	}
+
+	b, err := os.ReadFile(fname)
+	if err != nil {
+		return "", err
+	}
+	b, err = normalizers[normalize](b)
+	if err != nil {
+		return "", fmt.Errorf("normalizing %s as %s: %w", fname, normalize, err)
+	}
+	h := newHash()
+	h.Write(b)
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
@@ -0,0 +1,17 @@
+//go:build !windows
+
+package cache
+
+import (
+	"os"
+	"syscall"
+)
+
+// copyOwner makes the owner and group of p those recorded in info.
+func copyOwner(p string, info os.FileInfo) error {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+	return os.Lchown(p, int(st.Uid), int(st.Gid))
+}
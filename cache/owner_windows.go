@@ -0,0 +1,10 @@
+//go:build windows
+
+package cache
+
+import "os"
+
+// copyOwner is a no-op, Windows has no uid/gid ownership.
+func copyOwner(p string, info os.FileInfo) error {
+	return nil
+}
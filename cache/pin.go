@@ -0,0 +1,43 @@
+package cache
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+// Pin marks the entry for key as pinned, or unpins it, in its manifest.
+// Pinned entries are never evicted for MaxSize nor expired for their age,
+// so long-lived baselines survive the churn of others. An entry cached
+// before manifests were recorded gets one.
+func (c *Cache) Pin(key string, pinned bool) error {
+	if c.ReadOnly {
+		return ErrReadOnly
+	}
+	dir := filepath.Join(c.NamespaceDir(), key)
+	ok, err := EntryExists(dir)
+	if err != nil {
+		return err
+	}
+	if !validKey(key) || !ok {
+		return fmt.Errorf("no cache entry %s", key)
+	}
+	// keep eviction from removing it meanwhile
+	lock, err := LockEntry(dir, c.LockTimeout)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	m, err := ReadManifest(dir)
+	if err != nil {
+		return err
+	}
+	if m == nil {
+		m = &Manifest{Hash: keyAlgo(key), Version: Version}
+	}
+	if m.Pinned == pinned {
+		return nil
+	}
+	m.Pinned = pinned
+	return WriteManifest(dir, m)
+}
@@ -0,0 +1,47 @@
+//go:build !windows
+
+package cache
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// processAlive reports whether a process with pid runs on this host.
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	// EPERM means it's there, just not ours
+	return err == nil || err == syscall.EPERM
+}
+
+// newProcessGroup makes cmd start in a process group of its own, so
+// signalGroup reaches everything it spawns, and reports whether it did.
+// A cmd reading from our controlling terminal is left in our group: in one
+// of its own it would be in the background, and stopped by SIGTTIN as soon
+// as it read from the terminal.
+func newProcessGroup(cmd *exec.Cmd) bool {
+	if f, ok := cmd.Stdin.(*os.File); ok && controllingTerminal(f) {
+		return false
+	}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	return true
+}
+
+// controllingTerminal reports whether f is the controlling terminal of
+// this process. Only then does it have a foreground process group.
+func controllingTerminal(f *os.File) bool {
+	_, err := unix.IoctlGetInt(int(f.Fd()), unix.TIOCGPGRP)
+	return err == nil
+}
+
+// signalGroup sends sig to the process group led by p.
+func signalGroup(p *os.Process, sig os.Signal) error {
+	s, ok := sig.(syscall.Signal)
+	if !ok {
+		return p.Signal(sig)
+	}
+	return syscall.Kill(-p.Pid, s)
+}
@@ -0,0 +1,38 @@
+//go:build windows
+
+package cache
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// processAlive reports whether a process with pid runs on this host.
+func processAlive(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	p.Release()
+	return true
+}
+
+// newProcessGroup makes cmd start in a process group of its own and
+// reports that it did.
+func newProcessGroup(cmd *exec.Cmd) bool {
+	cmd.SysProcAttr = &syscall.SysProcAttr{CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP}
+	return true
+}
+
+// signalGroup stops p. Windows can't deliver signals to a group, so
+// anything but os.Interrupt kills just p.
+func signalGroup(p *os.Process, sig os.Signal) error {
+	if sig == os.Interrupt {
+		err := p.Signal(sig)
+		if err == nil {
+			return nil
+		}
+	}
+	return p.Kill()
+}
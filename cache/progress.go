@@ -0,0 +1,217 @@
+package cache
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Progress output formats.
+const (
+	LogText = "text"
+	LogJSON = "json"
+)
+
+// Logger is where progress and events go.
+type Logger struct {
+	W io.Writer
+	// Format is LogText or LogJSON.
+	Format string
+	// Quiet leaves out everything but errors.
+	Quiet bool
+	// Verbose adds the timings of each step and drops $PRETTY_PREFIX.
+	Verbose bool
+	// Color highlights some messages with ANSI colors, see ColorTerminal.
+	// It has no effect with Format LogJSON.
+	Color bool
+	// Timings prints how long each step took in total once an entry is
+	// installed, and adds them to its "done" event.
+	Timings bool
+
+	mu    sync.Mutex
+	steps []StepTiming
+}
+
+// StepTiming is the total time spent in the step Name, see Logger.Step.
+type StepTiming struct {
+	Name     string
+	Duration time.Duration
+}
+
+// Log is used by everything in the package reporting progress. Replace it
+// to capture or redirect the output.
+var Log = &Logger{W: os.Stderr, Format: LogText}
+
+// colors are the ANSI colors of messages starting with each prefix.
+var colors = []struct{ prefix, code string }{
+	{"Warning", "31"},
+	{"Succeeded", "32"},
+	{"Found cached", "32"},
+	{"Fetched", "32"},
+	{"Running", "33"},
+	{"Waiting", "33"},
+}
+
+// ColorTerminal reports whether f is a terminal progress may be colored
+// on. $NO_COLOR set to anything but empty and $TERM=dumb turn it off.
+func ColorTerminal(f *os.File) bool {
+	if os.Getenv("NO_COLOR") != "" || os.Getenv("TERM") == "dumb" {
+		return false
+	}
+	return isTerminal(f)
+}
+
+// colorize returns s in the color for its prefix, if any.
+func colorize(s string) string {
+	for _, c := range colors {
+		if strings.HasPrefix(s, c.prefix) {
+			return "\x1b[" + c.code + "m" + s + "\x1b[0m"
+		}
+	}
+	return s
+}
+
+// Event is emitted for things worth tracking, such as cache hits and
+// misses. Events are only written by Loggers with Format LogJSON, one JSON
+// object per line.
+type Event struct {
+	// Event is one of "hit", "miss", "generate", "done", "error", "log"
+	// or "progress".
+	Event      string    `json:"event"`
+	Time       time.Time `json:"time"`
+	Key        string    `json:"key,omitempty"`
+	DurationMS *int64    `json:"duration_ms,omitempty"`
+	Message    string    `json:"message,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	// Copied is set for "progress" events of copying a tree.
+	Copied *CopyCounts `json:"copied,omitempty"`
+	// TimingsMS are the durations of the steps by name, set for "done"
+	// events with Logger.Timings.
+	TimingsMS map[string]int64 `json:"timings_ms,omitempty"`
+}
+
+// CopyCounts is how far along copying a tree is. FilesTotal and
+// BytesTotal are 0 while the tree is still being totalled.
+type CopyCounts struct {
+	Files      int64 `json:"files"`
+	FilesTotal int64 `json:"files_total"`
+	Bytes      int64 `json:"bytes"`
+	BytesTotal int64 `json:"bytes_total"`
+}
+
+// Millis returns d in milliseconds for Event.DurationMS.
+func Millis(d time.Duration) *int64 {
+	ms := d.Milliseconds()
+	return &ms
+}
+
+// Event writes ev if progress is formatted as JSON. With Quiet only errors
+// are written.
+func (l *Logger) Event(ev Event) {
+	if l.Format != LogJSON || l.Quiet && ev.Event != "error" {
+		return
+	}
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	b, err := json.Marshal(ev)
+	if err != nil {
+		// can't happen with the fields of Event
+		panic(err)
+	}
+	fmt.Fprintf(l.W, "%s\n", b)
+}
+
+// Print writes s for humans. With Format LogJSON it is written as a "log"
+// event instead. $PRETTY_PREFIX is prepended unless Verbose is set.
+func (l *Logger) Print(s string) {
+	if l.Color && l.Format != LogJSON {
+		s = colorize(s)
+	}
+	switch {
+	case l.Quiet:
+	case l.Format == LogJSON:
+		l.Event(Event{Event: "log", Message: s})
+	case l.Verbose:
+		fmt.Fprintf(l.W, "%s\n", s)
+	default:
+		prefix := os.Getenv("PRETTY_PREFIX")
+		fmt.Fprintf(l.W, "%s%s\n", prefix, s)
+	}
+}
+
+// Step starts timing the step name. With Verbose calling the returned func
+// prints how long it took. The time is also added to that of earlier
+// steps of the same name, for Timings.
+func (l *Logger) Step(name string) (done func()) {
+	start := time.Now()
+	return func() {
+		took := time.Since(start)
+		if l.Verbose {
+			l.Print(fmt.Sprintf("%s took %v", name, took.Round(time.Microsecond)))
+		}
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		for i := range l.steps {
+			if l.steps[i].Name == name {
+				l.steps[i].Duration += took
+				return
+			}
+		}
+		l.steps = append(l.steps, StepTiming{name, took})
+	}
+}
+
+// TakeTimings returns the steps timed since it was last called, in the
+// order they were first taken, and starts over.
+func (l *Logger) TakeTimings() []StepTiming {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	steps := l.steps
+	l.steps = nil
+	return steps
+}
+
+// printTimings prints steps in one line with Timings and adds them to the
+// "done" event ev.
+func (l *Logger) printTimings(steps []StepTiming, ev *Event) {
+	if !l.Timings || len(steps) == 0 {
+		return
+	}
+	ev.TimingsMS = map[string]int64{}
+	parts := make([]string, len(steps))
+	for i, s := range steps {
+		ev.TimingsMS[s.Name] = s.Duration.Milliseconds()
+		parts[i] = fmt.Sprintf("%s %v", s.Name, s.Duration.Round(time.Microsecond))
+	}
+	if l.Format != LogJSON {
+		l.Print("Timings: " + strings.Join(parts, ", "))
+	}
+}
+
+// LogEvent writes ev to Log.
+func LogEvent(ev Event) {
+	Log.Event(ev)
+}
+
+func Progressf(format string, a ...interface{}) {
+	ProgressPrint(fmt.Sprintf(format, a...))
+}
+
+func Progress(a ...interface{}) {
+	ProgressPrint(fmt.Sprint(a...))
+}
+
+// ProgressPrint writes s to Log.
+func ProgressPrint(s string) {
+	Log.Print(s)
+}
+
+// Step times the step name with Log.
+func Step(name string) (done func()) {
+	return Log.Step(name)
+}
@@ -0,0 +1,47 @@
+package cache
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// ErrReadOnly is returned for attempts to add entries to a ReadOnly cache.
+var ErrReadOnly = errors.New("the cache is read-only")
+
+// findReadOnly looks up the cache entry for keys without writing to the
+// store. An entry pulled from the remote is kept in tmpStore, which the
+// caller removes once it has been installed.
+func (c *Cache) findReadOnly(keys []string, k KeySpec) (depDir string, cached bool, tmpStore string, err error) {
+	depDir, cached, err = c.lookup(keys)
+	if err != nil {
+		return "", false, "", err
+	}
+	if cached && c.Verify {
+		ok, err := Verify(depDir)
+		if err != nil {
+			return "", false, "", err
+		}
+		if !ok {
+			Progress("Cached dependencies are corrupt - ignoring them as the cache is read-only")
+			depDir, cached = filepath.Join(c.NamespaceDir(), keys[0]), false
+		}
+	}
+	if cached || c.Remote == nil {
+		return depDir, cached, "", nil
+	}
+
+	tmpStore, err = os.MkdirTemp("", "cache-pkgs-")
+	if err != nil {
+		return "", false, "", err
+	}
+	dir := filepath.Join(tmpStore, filepath.Base(depDir))
+	done := Step("remote fetch")
+	cached = c.pull(dir, k)
+	done()
+	if !cached {
+		os.RemoveAll(tmpStore)
+		return depDir, false, "", nil
+	}
+	return dir, true, tmpStore, nil
+}
@@ -0,0 +1,126 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// ErrCacheMiss is returned by Remote.Get for keys it has no entry for.
+// Implementations of Remote must return it, possibly wrapped, for misses.
+var ErrCacheMiss = errors.New("not in remote cache")
+
+// Remote is a shared cache which entries are pushed to and pulled from as
+// archives.
+type Remote interface {
+	// Get downloads the archive for key to the file dst. It returns
+	// ErrCacheMiss if there is none.
+	Get(key, dst string) error
+	// Put uploads the archive in the file src for key.
+	Put(key, src string) error
+	String() string
+}
+
+// RemoteTimeout bounds each request to an http(s) or s3 remote, the
+// transfer of the archive included, so a remote which hangs makes the run
+// fall back to generating the entry instead of stalling it. 0 waits
+// forever. Connecting and waiting for the response headers time out
+// sooner regardless.
+var RemoteTimeout = 30 * time.Minute
+
+// remoteTransport is that of the remotes' requests, see remoteClient.
+var remoteTransport = &http.Transport{
+	Proxy: http.ProxyFromEnvironment,
+	DialContext: (&net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}).DialContext,
+	ForceAttemptHTTP2:     true,
+	MaxIdleConns:          100,
+	IdleConnTimeout:       90 * time.Second,
+	TLSHandshakeTimeout:   10 * time.Second,
+	ResponseHeaderTimeout: time.Minute,
+	ExpectContinueTimeout: time.Second,
+}
+
+// remoteClient returns the client remotes send their requests with, see
+// RemoteTimeout.
+func remoteClient() *http.Client {
+	return &http.Client{Transport: remoteTransport, Timeout: RemoteTimeout}
+}
+
+// NewRemote returns the Remote for rawurl, e.g. "s3://bucket/prefix" or
+// "https://cache.example.com/pkgs".
+func NewRemote(rawurl string) (Remote, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "s3":
+		return newS3Remote(u)
+	case "http", "https":
+		return newHTTPRemote(u), nil
+	}
+	return nil, fmt.Errorf("unsupported remote %q", rawurl)
+}
+
+// Pull downloads the entry for key from r into the cache entry dir. With
+// keepArchive the entry is stored as the downloaded archive, otherwise it
+// is unpacked.
+func Pull(r Remote, key, dir string, keepArchive bool) error {
+	tmp := tmpDir(dir)
+	archive := tmp + archiveExt
+	defer os.Remove(archive)
+
+	err := r.Get(key, archive)
+	if err != nil {
+		return err
+	}
+	if keepArchive {
+		return CommitArchive(archive, dir)
+	}
+
+	err = extractArchiveFile(archive, tmp)
+	if err != nil {
+		return err
+	}
+	return CommitDir(tmp, dir)
+}
+
+// Push uploads the cache entry dir to r as key. Archived entries are
+// uploaded as is, others are archived with compression first.
+func Push(r Remote, key, dir, compression string) error {
+	if _, err := os.Stat(archivePath(dir)); err == nil {
+		return r.Put(key, archivePath(dir))
+	}
+
+	archive := tmpDir(dir) + archiveExt
+	defer os.Remove(archive)
+
+	err := writeEntryArchive(archive, compression, dir)
+	if err != nil {
+		return err
+	}
+	return r.Put(key, archive)
+}
+
+// download streams the body of resp to the file dst.
+func download(resp *http.Response, dst string) error {
+	defer resp.Body.Close()
+
+	f, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, resp.Body)
+	if errClose := f.Close(); err == nil {
+		err = errClose
+	}
+	return err
+}
@@ -0,0 +1,48 @@
+package cache
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRemoteTimeout(t *testing.T) {
+	hang := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-hang
+	}))
+	defer srv.Close()
+	defer close(hang)
+	defer func(d time.Duration) { RemoteTimeout = d }(RemoteTimeout)
+	RemoteTimeout = 100 * time.Millisecond
+
+	t.Setenv("AWS_ACCESS_KEY_ID", "id")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("AWS_ENDPOINT_URL", srv.URL)
+	for _, tc := range []struct{ name, url string }{
+		{"http", srv.URL},
+		{"s3", "s3://bucket/prefix"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := NewRemote(tc.url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			done := make(chan error, 1)
+			go func() {
+				done <- r.Get("key", filepath.Join(t.TempDir(), "entry.tar.gz"))
+			}()
+			select {
+			case err := <-done:
+				if err == nil || errors.Is(err, ErrCacheMiss) {
+					t.Errorf("got %v from a hanging remote, want an error", err)
+				}
+			case <-time.After(10 * time.Second):
+				t.Fatal("Get didn't give up on a hanging remote")
+			}
+		})
+	}
+}
@@ -0,0 +1,72 @@
+package cache
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Rewrite replaces Old with New in installed files, for tools baking the
+// absolute path they were generated at into their output.
+type Rewrite struct {
+	Old, New string
+}
+
+// ParseRewrite parses "old=new".
+func ParseRewrite(s string) (Rewrite, error) {
+	old, repl, ok := strings.Cut(s, "=")
+	if !ok || old == "" {
+		return Rewrite{}, fmt.Errorf("bad rewrite %q, want old=new", s)
+	}
+	return Rewrite{Old: old, New: repl}, nil
+}
+
+// errRewriteSymlink is returned when rewriting is asked for with
+// InstallSymlink, which would rewrite the cached files themselves.
+var errRewriteSymlink = errors.New("can't rewrite installed files and symlink them to the cache at the same time")
+
+// rewriteTree applies rewrites to the files below dir matching patterns,
+// see excluded. Files are replaced rather than written to, so hardlinks
+// into the cache are broken instead of changing the cached file.
+func rewriteTree(dir string, rewrites []Rewrite, patterns []string) error {
+	return filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		if !excluded(filepath.ToSlash(rel), false, patterns) {
+			return nil
+		}
+		b, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		changed := b
+		for _, r := range rewrites {
+			changed = bytes.ReplaceAll(changed, []byte(r.Old), []byte(r.New))
+		}
+		if bytes.Equal(changed, b) {
+			return nil
+		}
+
+		tmp := tmpDir(p)
+		err = os.WriteFile(tmp, changed, 0600)
+		if err == nil {
+			err = os.Chmod(tmp, info.Mode())
+		}
+		if err == nil {
+			err = os.Rename(tmp, p)
+		}
+		if err != nil {
+			os.Remove(tmp)
+			return &CopyError{Path: p, Err: err}
+		}
+		return nil
+	})
+}
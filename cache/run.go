@@ -0,0 +1,153 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// killGrace is how long a timed out command gets to exit after SIGTERM
+// before it is killed.
+const killGrace = 10 * time.Second
+
+var (
+	// ErrTimeout is wrapped by the errors of commands which ran longer
+	// than Cache.Timeout.
+	ErrTimeout = errors.New("command timed out")
+	// ErrInterrupted is wrapped by the errors of commands which were
+	// stopped because we got SIGINT or SIGTERM while they ran.
+	ErrInterrupted = errors.New("command interrupted")
+)
+
+// run runs bin in a process group of its own. SIGINT and SIGTERM are
+// relayed to the group, as it no longer gets them from the terminal, and a
+// second one kills it. With a timeout the whole group is sent SIGTERM once
+// it expires, and SIGKILL if it is still around killGrace later. env is
+// added to the inherited environment. It runs in dir, unless that is empty.
+//
+// When stdin is our controlling terminal bin stays in our group instead,
+// see newProcessGroup. The terminal then sends it SIGINT itself, and the
+// signals above reach bin only, not what it spawned.
+func run(dir string, timeout time.Duration, env []string, bin string, args ...string) error {
+	cmd := exec.Command(bin, args...)
+	cmd.Dir = dir
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	grouped := newProcessGroup(cmd)
+	stop := func(sig os.Signal) {
+		if grouped {
+			signalGroup(cmd.Process, sig)
+		} else {
+			cmd.Process.Signal(sig)
+		}
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+
+	err := cmd.Start()
+	if err != nil {
+		return err
+	}
+
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	select {
+	case err := <-exited:
+		return err
+	case sig := <-sigs:
+		if grouped || sig != os.Interrupt {
+			// bin sharing our terminal got SIGINT from it already
+			stop(sig)
+		}
+		select {
+		case <-exited:
+		case <-sigs:
+			// asked twice, stop waiting for it to wind down
+			stop(os.Kill)
+			<-exited
+		}
+		return fmt.Errorf("%w: %v", ErrInterrupted, sig)
+	case <-ctx.Done():
+	}
+
+	stop(syscall.SIGTERM)
+	select {
+	case <-exited:
+	case <-time.After(killGrace):
+		stop(os.Kill)
+		<-exited
+	}
+	return fmt.Errorf("%w after %v", ErrTimeout, timeout)
+}
+
+// RunSpecCmd runs the -spec-cmd cmd and returns its output, for
+// KeySpec.SpecOutput. Its stderr is passed on.
+func RunSpecCmd(cmd []string) ([]byte, error) {
+	c := exec.Command(cmd[0], cmd[1:]...)
+	c.Stdin, c.Stderr = os.Stdin, os.Stderr
+	out, err := c.Output()
+	if err != nil {
+		return nil, fmt.Errorf("spec command `%s`: %w", strings.Join(cmd, " "), err)
+	}
+	return out, nil
+}
+
+// ToolOutput is the output of a -key-tool command, see KeySpec.Tools.
+type ToolOutput struct {
+	Cmd []string
+	// Output is what the command wrote to stdout and stderr, as some tools
+	// print their version to either, with surrounding space trimmed.
+	Output []byte
+}
+
+// RunKeyTools runs the -key-tool cmds and returns their outputs, for
+// KeySpec.Tools. Any of them failing is an error.
+func RunKeyTools(cmds [][]string) ([]ToolOutput, error) {
+	var tools []ToolOutput
+	for _, cmd := range cmds {
+		out, err := exec.Command(cmd[0], cmd[1:]...).CombinedOutput()
+		out = bytes.TrimSpace(out)
+		if err != nil && len(out) > 0 {
+			return nil, fmt.Errorf("key tool `%s`: %w: %s", strings.Join(cmd, " "), err, out)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("key tool `%s`: %w", strings.Join(cmd, " "), err)
+		}
+		tools = append(tools, ToolOutput{Cmd: cmd, Output: out})
+	}
+	return tools, nil
+}
+
+// runHook runs the hook cmd named name, if there is one.
+func runHook(name string, cmd []string) error {
+	if len(cmd) == 0 {
+		return nil
+	}
+	done := Step(name + " hook")
+	defer done()
+	Progressf("Running %s hook `%s`", name, strings.Join(cmd, " "))
+	err := run("", 0, nil, cmd[0], cmd[1:]...)
+	if err != nil {
+		return fmt.Errorf("%s hook `%s`: %w", name, strings.Join(cmd, " "), err)
+	}
+	return nil
+}
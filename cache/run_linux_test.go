@@ -0,0 +1,99 @@
+package cache
+
+import (
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// openPty returns the master and slave ends of a new pseudo terminal.
+func openPty(t *testing.T) (master, slave *os.File) {
+	t.Helper()
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		t.Skip("no pseudo terminals:", err)
+	}
+	t.Cleanup(func() { master.Close() })
+	fd := int(master.Fd())
+	err = unix.IoctlSetPointerInt(fd, unix.TIOCSPTLCK, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := unix.IoctlGetUint32(fd, unix.TIOCGPTN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slave, err = os.OpenFile("/dev/pts/"+strconv.Itoa(int(n)), os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { slave.Close() })
+	return master, slave
+}
+
+// TestRunReadsTerminal runs a command reading stdin from a session whose
+// controlling terminal it is, as from an interactive shell. In a
+// background process group of its own the read would stop it.
+func TestRunReadsTerminal(t *testing.T) {
+	master, slave := openPty(t)
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(exe, helperFlag, "run", exe, helperFlag, "read")
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = slave, slave, slave
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true, Setctty: true}
+	err = cmd.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		// keep the terminal's output from filling up
+		buf := make([]byte, 1024)
+		for {
+			if _, err := master.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+	_, err = master.Write([]byte("y\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	select {
+	case err := <-exited:
+		if err != nil {
+			t.Fatalf("the command failed: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		<-exited
+		t.Fatal("the command never read the terminal, it was likely stopped by SIGTTIN")
+	}
+}
+
+// TestNewProcessGroup keeps commands in a group of their own unless stdin
+// is the controlling terminal, which a terminal of another session isn't.
+func TestNewProcessGroup(t *testing.T) {
+	_, slave := openPty(t)
+	null, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer null.Close()
+	for _, stdin := range []*os.File{null, slave} {
+		cmd := exec.Command("true")
+		cmd.Stdin = stdin
+		if !newProcessGroup(cmd) {
+			t.Errorf("no process group with stdin %s", stdin.Name())
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package cache
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// s3Remote stores entries as "<prefix>/<key>.tar.gz" objects in an S3
+// bucket. Credentials and region come from the standard AWS_* environment
+// variables. AWS_ENDPOINT_URL points it at S3 compatible storage.
+type s3Remote struct {
+	bucket, prefix string
+	region         string
+	endpoint       *url.URL
+	keyID, secret  string
+	token          string
+}
+
+func newS3Remote(u *url.URL) (*s3Remote, error) {
+	r := &s3Remote{
+		bucket: u.Host,
+		prefix: strings.Trim(u.Path, "/"),
+		keyID:  os.Getenv("AWS_ACCESS_KEY_ID"),
+		secret: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		token:  os.Getenv("AWS_SESSION_TOKEN"),
+		region: os.Getenv("AWS_REGION"),
+	}
+	if r.bucket == "" {
+		return nil, fmt.Errorf("no bucket in %q", u)
+	}
+	if r.keyID == "" || r.secret == "" {
+		return nil, errors.New("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set for an s3 remote")
+	}
+	if r.region == "" {
+		r.region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if r.region == "" {
+		r.region = "us-east-1"
+	}
+
+	endpoint := os.Getenv("AWS_ENDPOINT_URL")
+	if endpoint == "" {
+		endpoint = "https://s3." + r.region + ".amazonaws.com"
+	}
+	var err error
+	r.endpoint, err = url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("bad AWS_ENDPOINT_URL: %w", err)
+	}
+	return r, nil
+}
+
+func (r *s3Remote) String() string {
+	return "s3://" + path.Join(r.bucket, r.prefix)
+}
+
+func (r *s3Remote) Get(key, dst string) error {
+	resp, err := r.do("GET", key, nil, 0)
+	if err != nil {
+		return err
+	}
+	return download(resp, dst)
+}
+
+func (r *s3Remote) Put(key, src string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	resp, err := r.do("PUT", key, f, info.Size())
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// do sends a signed request for the object of key. Responses other than
+// 2xx are turned into errors, 404 into ErrCacheMiss.
+func (r *s3Remote) do(method, key string, body io.Reader, size int64) (*http.Response, error) {
+	u := *r.endpoint
+	// path style addressing works for all buckets and S3 lookalikes
+	u.Path = "/" + path.Join(r.bucket, r.prefix, key+".tar.gz")
+	u.RawPath = awsEscapePath(u.Path)
+
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = size
+	r.sign(req, time.Now().UTC())
+
+	resp, err := remoteClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 == 2 {
+		return resp, nil
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrCacheMiss
+	}
+	return nil, fmt.Errorf("%s %s: %s", method, u.String(), resp.Status)
+}
+
+// sign adds an AWS signature version 4 Authorization header to req. The
+// payload isn't signed, which S3 allows.
+func (r *s3Remote) sign(req *http.Request, now time.Time) {
+	const payload = "UNSIGNED-PAYLOAD"
+	amzDate := now.Format("20060102T150405Z")
+	date := amzDate[:8]
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payload)
+	if r.token != "" {
+		req.Header.Set("X-Amz-Security-Token", r.token)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k := range req.Header {
+		if lk := strings.ToLower(k); strings.HasPrefix(lk, "x-amz-") {
+			headers[lk] = strings.TrimSpace(req.Header.Get(k))
+		}
+	}
+	var names []string
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonHeaders strings.Builder
+	for _, k := range names {
+		canonHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signed := strings.Join(names, ";")
+
+	canonReq := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonHeaders.String(),
+		signed,
+		payload,
+	}, "\n")
+
+	scope := date + "/" + r.region + "/s3/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hexSHA256(canonReq)
+
+	k := hmacSHA256([]byte("AWS4"+r.secret), date)
+	k = hmacSHA256(k, r.region)
+	k = hmacSHA256(k, "s3")
+	k = hmacSHA256(k, "aws4_request")
+	sig := fmt.Sprintf("%x", hmacSHA256(k, toSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", r.keyID, scope, signed, sig))
+}
+
+// awsEscapePath escapes p the way AWS expects in canonical requests, which
+// is stricter than url.PathEscape.
+func awsEscapePath(p string) string {
+	var b strings.Builder
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-._~/", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	io.WriteString(h, data)
+	return h.Sum(nil)
+}
+
+func hexSHA256(s string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(s)))
+}
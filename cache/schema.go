@@ -0,0 +1,20 @@
+package cache
+
+import (
+	"encoding/json"
+	"io"
+)
+
+// SchemaVersion is the version of the JSON written by List, Stats, Size
+// and Show, given as its "schemaVersion" field. The JSON is meant to be
+// parsed by other programs: fields may be added within a version, but
+// removing or renaming one or changing its type or meaning bumps it. The
+// text output gives no such promise.
+const SchemaVersion = 1
+
+// writeJSON writes the JSON object v to w, indented.
+func writeJSON(w io.Writer, v interface{}) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
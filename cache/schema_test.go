@@ -0,0 +1,95 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+// TestJSONSchema checks the fields programs parsing the JSON output rely
+// on, see SchemaVersion. Fields may be added, so only presence is checked.
+func TestJSONSchema(t *testing.T) {
+	c, e := cachedEntry(t)
+	store := c.NamespaceDir()
+	for _, tc := range []struct {
+		name  string
+		write func(*bytes.Buffer) error
+		want  []string
+	}{
+		{"list", func(b *bytes.Buffer) error { return List(b, store, 0, true) },
+			[]string{"entries"}},
+		{"stats", func(b *bytes.Buffer) error { return Stats(b, store, true) },
+			[]string{"runs", "hits", "misses", "hit_rate", "avg_hit_ms", "avg_miss_ms", "saved_ms", "total_saved_ms"}},
+		{"size", func(b *bytes.Buffer) error { return Size(b, store, true) },
+			[]string{"entries", "bytes", "largest", "free"}},
+		{"show", func(b *bytes.Buffer) error { return c.Show(b, e.Key, true) },
+			[]string{"key", "format", "top", "files", "bytes", "manifest"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var b bytes.Buffer
+			err := tc.write(&b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got map[string]interface{}
+			err = json.Unmarshal(b.Bytes(), &got)
+			if err != nil {
+				t.Fatalf("%v in %s", err, b.String())
+			}
+			if v, ok := got["schemaVersion"].(float64); !ok || v != SchemaVersion {
+				t.Errorf("schemaVersion is %v, want %d", got["schemaVersion"], SchemaVersion)
+			}
+			for _, f := range tc.want {
+				if _, ok := got[f]; !ok {
+					t.Errorf("no %q in %s", f, b.String())
+				}
+			}
+		})
+	}
+}
+
+func TestJSONListEntry(t *testing.T) {
+	c, e := cachedEntry(t)
+	var b bytes.Buffer
+	err := List(&b, c.NamespaceDir(), 0, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got struct {
+		Entries []map[string]interface{} `json:"entries"`
+	}
+	err = json.Unmarshal(b.Bytes(), &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Entries) != 1 {
+		t.Fatalf("got %d entries, want 1", len(got.Entries))
+	}
+	entry := got.Entries[0]
+	if entry["key"] != e.Key {
+		t.Errorf("key is %v, want %s", entry["key"], e.Key)
+	}
+	for _, f := range []string{"dir", "archived", "cas", "size", "created", "lastUsed", "manifest", "pinned"} {
+		if _, ok := entry[f]; !ok {
+			t.Errorf("no %q in the entry %v", f, entry)
+		}
+	}
+}
+
+func TestJSONListEmpty(t *testing.T) {
+	c, _, _ := testCache(t, InstallSymlink)
+	var b bytes.Buffer
+	err := List(&b, c.NamespaceDir(), 0, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]interface{}
+	err = json.Unmarshal(b.Bytes(), &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// an array even if empty, not null
+	if entries, ok := got["entries"].([]interface{}); !ok || len(entries) != 0 {
+		t.Errorf("entries of an empty store is %v, want []", got["entries"])
+	}
+}
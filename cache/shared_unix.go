@@ -0,0 +1,12 @@
+//go:build !windows
+
+package cache
+
+import "syscall"
+
+// ShareWithGroup sets the umask of the process to 002, so what it creates,
+// including what the command generates, is writable by the group. The
+// store dirs still need SharedDirMode.
+func ShareWithGroup() {
+	syscall.Umask(0002)
+}
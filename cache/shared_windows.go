@@ -0,0 +1,5 @@
+package cache
+
+// ShareWithGroup does nothing on Windows, where access to the store is a
+// matter of ACLs inherited from the cache dir.
+func ShareWithGroup() {}
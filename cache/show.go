@@ -0,0 +1,229 @@
+package cache
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Entry formats reported by EntryTree.
+const (
+	FormatDir     = "dir"
+	FormatArchive = "archive"
+	FormatCAS     = "cas"
+)
+
+// EntryTree summarizes what a cache entry would install.
+type EntryTree struct {
+	Key    string `json:"key"`
+	Format string `json:"format"`
+	// Top are the slash separated paths at the root of the tree, dirs
+	// ending in a slash. With several outputs those at the root of each.
+	Top []string `json:"top"`
+	// Files counts the files and symlinks, Bytes is the uncompressed size
+	// of the files.
+	Files    int64     `json:"files"`
+	Bytes    int64     `json:"bytes"`
+	Manifest *Manifest `json:"manifest,omitempty"`
+}
+
+// Tree summarizes the entry for key without installing it. Archived entries
+// are read through, not extracted.
+func (c *Cache) Tree(key string) (*EntryTree, error) {
+	dir := filepath.Join(c.NamespaceDir(), key)
+	ok, err := EntryExists(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !validKey(key) || !ok {
+		return nil, fmt.Errorf("no cache entry %s", key)
+	}
+
+	t := &EntryTree{Key: key}
+	if m, err := ReadManifest(dir); err == nil {
+		t.Manifest = m
+	}
+	// several outputs are numbered subdirs
+	depth := 1
+	if t.Manifest != nil && len(t.Manifest.Outputs) > 1 {
+		depth = 2
+	}
+	add := func(rel string, isDir bool, size int64) {
+		rel = path.Clean(rel)
+		if rel == "." {
+			return
+		}
+		if n := strings.Count(rel, "/") + 1; n == depth {
+			if isDir {
+				rel += "/"
+			}
+			t.Top = append(t.Top, rel)
+		}
+		if !isDir {
+			t.Files++
+			t.Bytes += size
+		}
+	}
+
+	switch {
+	case fileExists(archivePath(dir)):
+		t.Format = FormatArchive
+		err = walkArchive(archivePath(dir), add)
+	case fileExists(casPath(dir)):
+		t.Format = FormatCAS
+		err = walkCAS(dir, add)
+	default:
+		t.Format = FormatDir
+		err = filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(dir, p)
+			if err != nil {
+				return err
+			}
+			switch {
+			case info.IsDir():
+				add(filepath.ToSlash(rel), true, 0)
+			case info.Mode().IsRegular(), info.Mode()&os.ModeSymlink != 0:
+				add(filepath.ToSlash(rel), false, regularSize(info))
+			}
+			return nil
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(t.Top)
+	return t, nil
+}
+
+// regularSize is the size of the file info describes, 0 unless it is a
+// regular file.
+func regularSize(info os.FileInfo) int64 {
+	if !info.Mode().IsRegular() {
+		return 0
+	}
+	return info.Size()
+}
+
+func fileExists(p string) bool {
+	_, err := os.Stat(p)
+	return err == nil
+}
+
+// walkArchive calls add for each dir, file and symlink in the archive p.
+func walkArchive(p string, add func(rel string, isDir bool, size int64)) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	zr, err := decompressReader(f)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+	tr := tar.NewReader(zr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", p, err)
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			add(hdr.Name, true, 0)
+		case tar.TypeReg:
+			add(hdr.Name, false, hdr.Size)
+		case tar.TypeSymlink:
+			add(hdr.Name, false, 0)
+		}
+	}
+}
+
+// walkCAS calls add for each path in the index of the cache entry dir,
+// sizing files by their blobs.
+func walkCAS(dir string, add func(rel string, isDir bool, size int64)) error {
+	idx, err := readCAS(casPath(dir))
+	if err != nil {
+		return err
+	}
+	for _, f := range idx.Files {
+		var size int64
+		if f.Blob != "" {
+			info, err := os.Stat(blobPath(filepath.Dir(dir), f.Blob))
+			if err != nil {
+				return err
+			}
+			size = info.Size()
+		}
+		add(f.Path, f.Mode.IsDir(), size)
+	}
+	return nil
+}
+
+// Show writes the summary of the entry for key to w, see Tree, either for
+// humans or, with asJSON, as JSON, see SchemaVersion.
+func (c *Cache) Show(w io.Writer, key string, asJSON bool) error {
+	t, err := c.Tree(key)
+	if err != nil {
+		return err
+	}
+	if asJSON {
+		if t.Top == nil {
+			t.Top = []string{}
+		}
+		return writeJSON(w, struct {
+			SchemaVersion int `json:"schemaVersion"`
+			*EntryTree
+		}{SchemaVersion, t})
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "Key:\t%s\n", t.Key)
+	fmt.Fprintf(tw, "Format:\t%s\n", t.Format)
+	fmt.Fprintf(tw, "Files:\t%d\n", t.Files)
+	fmt.Fprintf(tw, "Size:\t%s\n", FormatSize(t.Bytes))
+	if m := t.Manifest; m != nil {
+		spec := strings.Join(m.Spec, ",")
+		if len(m.SpecCmd) > 0 {
+			spec = "`" + strings.Join(m.SpecCmd, " ") + "`"
+		}
+		fmt.Fprintf(tw, "Spec:\t%s\n", spec)
+		fmt.Fprintf(tw, "Command:\t%s\n", strings.Join(m.Cmd, " "))
+		if len(m.Outputs) > 0 {
+			fmt.Fprintf(tw, "Outputs:\t%s\n", strings.Join(m.Outputs, ","))
+		}
+		if len(m.Exclude) > 0 {
+			fmt.Fprintf(tw, "Exclude:\t%s\n", strings.Join(m.Exclude, ","))
+		}
+		fmt.Fprintf(tw, "Created:\t%s\n", m.Created.Format(timeFormat))
+		if m.BuildMS > 0 {
+			fmt.Fprintf(tw, "Build time:\t%v\n", time.Duration(m.BuildMS)*time.Millisecond)
+		}
+		if m.Source != "" {
+			fmt.Fprintf(tw, "Source:\t%s\n", m.Source)
+		}
+		fmt.Fprintf(tw, "Version:\t%s\n", m.Version)
+		if m.Pinned {
+			fmt.Fprintln(tw, "Pinned:\tyes")
+		}
+	}
+	if len(t.Top) > 0 {
+		fmt.Fprintln(tw, "Contents:")
+	}
+	for _, p := range t.Top {
+		fmt.Fprintf(tw, "  %s\n", p)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,121 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"text/tabwriter"
+)
+
+// largestEntries is how many entries SizeReport lists by size.
+const largestEntries = 5
+
+// SizeReport is how much room a store takes up.
+type SizeReport struct {
+	Entries int `json:"entries"`
+	// Bytes is everything in the store, including manifests, blobs,
+	// namespaces and temporary dirs of runs in progress.
+	Bytes int64 `json:"bytes"`
+	// Largest are the biggest entries, largest first.
+	Largest []Entry `json:"largest"`
+	// Free is what is left on the device of the store, -1 if unknown.
+	Free int64 `json:"free"`
+}
+
+// ReportSize walks cacheStore to tell how large it is. It only reads, so
+// it's safe while other runs add and remove entries.
+func ReportSize(cacheStore string) (*SizeReport, error) {
+	entries, err := sizedEntries(cacheStore)
+	if err != nil {
+		return nil, err
+	}
+	r := &SizeReport{Free: -1, Largest: entries}
+	r.Entries = len(r.Largest)
+	sort.Slice(r.Largest, func(i, j int) bool {
+		return r.Largest[i].Size > r.Largest[j].Size
+	})
+	if len(r.Largest) > largestEntries {
+		r.Largest = r.Largest[:largestEntries]
+	}
+
+	err = filepath.Walk(cacheStore, func(p string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		r.Bytes += info.Size()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	free, err := diskFree(cacheStore)
+	if err != nil {
+		Progress("Can't tell free space: ", err)
+	} else {
+		r.Free = free
+	}
+	return r, nil
+}
+
+// sizedEntries returns the entries in cacheStore with their sizes, leaving
+// out those removed by other runs while going through them.
+func sizedEntries(cacheStore string) ([]Entry, error) {
+	entries, err := Entries(cacheStore)
+	if err != nil {
+		return nil, err
+	}
+	var sized []Entry
+	for _, e := range entries {
+		es := []Entry{e}
+		err := EntrySizes(es)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		sized = append(sized, es[0])
+	}
+	return sized, nil
+}
+
+// Size writes the size report of cacheStore to w, as JSON with asJSON, see
+// SchemaVersion.
+func Size(w io.Writer, cacheStore string, asJSON bool) error {
+	r, err := ReportSize(cacheStore)
+	if err != nil {
+		return err
+	}
+	if asJSON {
+		if r.Largest == nil {
+			r.Largest = []Entry{}
+		}
+		return writeJSON(w, struct {
+			SchemaVersion int `json:"schemaVersion"`
+			*SizeReport
+		}{SchemaVersion, r})
+	}
+
+	free := "unknown"
+	if r.Free >= 0 {
+		free = FormatSize(r.Free)
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "Entries:\t%d\n", r.Entries)
+	fmt.Fprintf(tw, "Total:\t%s\n", FormatSize(r.Bytes))
+	fmt.Fprintf(tw, "Free:\t%s\n", free)
+	if len(r.Largest) > 0 {
+		fmt.Fprintln(tw, "Largest:")
+	}
+	for _, e := range r.Largest {
+		fmt.Fprintf(tw, "  %s\t%s\n", e.Key, FormatSize(e.Size))
+	}
+	return tw.Flush()
+}
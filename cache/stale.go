@@ -0,0 +1,70 @@
+package cache
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// StaleOutput is an output linking to another entry than the one for the
+// current dependency descriptions.
+type StaleOutput struct {
+	Output string
+	// Key is that of the entry the output links to.
+	Key string
+}
+
+// Stale returns the outputs which are symlinks into the store to an entry
+// other than the one for k, as left behind by changing the dependency
+// descriptions without rerunning, along with the current key. Outputs not
+// linking into the store are skipped, there is no telling what they hold.
+func (c *Cache) Stale(k KeySpec, outputs []string) (stale []StaleOutput, key string, err error) {
+	keys, err := c.keys(k)
+	if err != nil {
+		return nil, "", err
+	}
+	store, err := resolvePath(c.NamespaceDir())
+	if err != nil {
+		return nil, "", err
+	}
+
+	for _, out := range outputs {
+		linked, ok := linkedKey(out, store)
+		if !ok {
+			continue
+		}
+		current := false
+		for _, want := range keys {
+			current = current || linked == want
+		}
+		if !current {
+			stale = append(stale, StaleOutput{Output: out, Key: linked})
+		}
+	}
+	return stale, keys[0], nil
+}
+
+// linkedKey returns the key of the entry in store the symlink out points
+// into, if it does.
+func linkedKey(out, store string) (string, bool) {
+	target, err := os.Readlink(out)
+	if err != nil {
+		return "", false
+	}
+	if !filepath.IsAbs(target) {
+		target = filepath.Join(filepath.Dir(out), target)
+	}
+	target, err = resolvePath(target)
+	if err != nil || !within(target, store) || target == store {
+		return "", false
+	}
+	rel, err := filepath.Rel(store, target)
+	if err != nil {
+		return "", false
+	}
+	key, rest, _ := strings.Cut(rel, string(filepath.Separator))
+	if key == extractedDir {
+		key, _, _ = strings.Cut(rest, string(filepath.Separator))
+	}
+	return key, key != ""
+}
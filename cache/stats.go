@@ -0,0 +1,147 @@
+package cache
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+)
+
+// statsLog is the file in the cache store every run is appended to.
+const statsLog = "stats.log"
+
+// Run is a line of the stats log.
+type Run struct {
+	Time       time.Time `json:"time"`
+	Key        string    `json:"key"`
+	Hit        bool      `json:"hit"`
+	DurationMS int64     `json:"duration_ms"`
+}
+
+// RecordRun appends r to the stats log of cacheStore. Lines are written
+// with a single append, so concurrent runs don't interleave.
+func RecordRun(cacheStore string, r Run) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(cacheStore, statsLog), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(b, '\n'))
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Summary sums up the stats log.
+type Summary struct {
+	Runs   int `json:"runs"`
+	Hits   int `json:"hits"`
+	Misses int `json:"misses"`
+	// HitRate is Hits/Runs.
+	HitRate float64 `json:"hit_rate"`
+	// AvgHitMS and AvgMissMS are the average durations of hits and misses.
+	AvgHitMS  int64 `json:"avg_hit_ms"`
+	AvgMissMS int64 `json:"avg_miss_ms"`
+	// SavedMS is the time a hit saves on average, AvgMissMS-AvgHitMS,
+	// and TotalSavedMS that for all hits.
+	SavedMS      int64 `json:"saved_ms"`
+	TotalSavedMS int64 `json:"total_saved_ms"`
+	// Entries and Bytes are what the cache holds now.
+	Entries int   `json:"entries"`
+	Bytes   int64 `json:"bytes"`
+}
+
+// Summarize reads the stats log of cacheStore.
+func Summarize(cacheStore string) (*Summary, error) {
+	s := &Summary{}
+	var hitMS, missMS int64
+
+	f, err := os.Open(filepath.Join(cacheStore, statsLog))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		defer f.Close()
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			var r Run
+			if json.Unmarshal(sc.Bytes(), &r) != nil {
+				// a torn line from a full disk or similar
+				continue
+			}
+			s.Runs++
+			if r.Hit {
+				s.Hits++
+				hitMS += r.DurationMS
+			} else {
+				s.Misses++
+				missMS += r.DurationMS
+			}
+		}
+		if err := sc.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	if s.Runs > 0 {
+		s.HitRate = float64(s.Hits) / float64(s.Runs)
+	}
+	if s.Hits > 0 {
+		s.AvgHitMS = hitMS / int64(s.Hits)
+	}
+	if s.Misses > 0 {
+		s.AvgMissMS = missMS / int64(s.Misses)
+	}
+	if s.Hits > 0 && s.Misses > 0 && s.AvgMissMS > s.AvgHitMS {
+		s.SavedMS = s.AvgMissMS - s.AvgHitMS
+		s.TotalSavedMS = s.SavedMS * int64(s.Hits)
+	}
+
+	entries, err := Entries(cacheStore)
+	if err == nil {
+		err = EntrySizes(entries)
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.Entries = len(entries)
+	for _, e := range entries {
+		s.Bytes += e.Size
+	}
+	return s, nil
+}
+
+// Stats writes the summary of cacheStore's stats log to w, as JSON with
+// asJSON, see SchemaVersion.
+func Stats(w io.Writer, cacheStore string, asJSON bool) error {
+	s, err := Summarize(cacheStore)
+	if err != nil {
+		return err
+	}
+	if asJSON {
+		return writeJSON(w, struct {
+			SchemaVersion int `json:"schemaVersion"`
+			*Summary
+		}{SchemaVersion, s})
+	}
+
+	ms := func(n int64) time.Duration { return time.Duration(n) * time.Millisecond }
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "Runs:\t%d (%d hits, %d misses)\n", s.Runs, s.Hits, s.Misses)
+	fmt.Fprintf(tw, "Hit rate:\t%.1f%%\n", s.HitRate*100)
+	fmt.Fprintf(tw, "Avg hit:\t%v\n", ms(s.AvgHitMS))
+	fmt.Fprintf(tw, "Avg miss:\t%v\n", ms(s.AvgMissMS))
+	fmt.Fprintf(tw, "Saved per hit:\t%v\n", ms(s.SavedMS))
+	fmt.Fprintf(tw, "Saved in total:\t%v\n", ms(s.TotalSavedMS))
+	fmt.Fprintf(tw, "Cached:\t%s in %d entries\n", FormatSize(s.Bytes), s.Entries)
+	return tw.Flush()
+}
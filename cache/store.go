@@ -0,0 +1,463 @@
+package cache
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tmpMarker separates the key from the owner of a temporary directory an
+// entry is populated in before being renamed into place.
+const tmpMarker = ".tmp."
+
+// DirMode is the mode of the dirs created in the store, including the
+// store itself and the root dir of entries. It is applied regardless of
+// the umask.
+var DirMode os.FileMode = 0750
+
+// SharedDirMode is the DirMode for a store shared by the users of a
+// group: group writable and setgid, so everything created in it belongs
+// to the group of the cache dir, whichever user's run created it. See also
+// ShareWithGroup.
+const SharedDirMode = os.ModeSetgid | 0770
+
+// mkdirStore creates dir and its missing parents with DirMode.
+func mkdirStore(dir string) error {
+	if ok, err := IsDir(dir); ok || err != nil {
+		return err
+	}
+	if parent := filepath.Dir(dir); parent != dir {
+		err := mkdirStore(parent)
+		if err != nil {
+			return err
+		}
+	}
+	err := os.Mkdir(dir, DirMode)
+	if os.IsExist(err) {
+		// created by someone else meanwhile
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return os.Chmod(dir, DirMode)
+}
+
+// tmpDir returns the temporary sibling directory this process populates
+// the cache entry dir in.
+func tmpDir(dir string) string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s%s%s.%d", dir, tmpMarker, host, os.Getpid())
+}
+
+// CommitArchive atomically moves the complete archive tmp into place as
+// the archive of the cache entry dir.
+func CommitArchive(tmp, dir string) error {
+	err := os.Rename(tmp, archivePath(dir))
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// CommitDir atomically moves the fully populated tmp into place as the
+// cache entry dir, with DirMode. If another process already committed the
+// entry tmp is discarded.
+//
+// The modification time of the entry dir records when it was cached.
+func CommitDir(tmp, dir string) error {
+	now := time.Now()
+	err := os.Chmod(tmp, DirMode)
+	if err == nil {
+		err = os.Chtimes(tmp, now, now)
+	}
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp, dir)
+	if err == nil {
+		return nil
+	}
+	if cached, _ := IsDir(dir); cached {
+		return os.RemoveAll(tmp)
+	}
+	errRm := os.RemoveAll(tmp)
+	if errRm != nil {
+		return errRm
+	}
+	return err
+}
+
+// CleanTmp removes temporary directories left behind in cacheStore by runs
+// that crashed. Directories of processes still running on this host are
+// left alone.
+func CleanTmp(cacheStore string) error {
+	leftovers, err := leftoverTmp(cacheStore)
+	if err != nil {
+		return err
+	}
+	for _, p := range leftovers {
+		Progress("Removing leftover ", filepath.Base(p))
+		err = os.RemoveAll(p)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// leftoverTmp returns the temporary directories in cacheStore, and its
+// extraction cache, of crashed runs on this host.
+func leftoverTmp(cacheStore string) ([]string, error) {
+	leftovers, err := leftoverTmpIn(cacheStore)
+	if err != nil {
+		return nil, err
+	}
+	extractLeftovers, err := leftoverTmpIn(filepath.Join(cacheStore, extractedDir))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return append(leftovers, extractLeftovers...), nil
+}
+
+func leftoverTmpIn(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	host, _ := os.Hostname()
+	var leftovers []string
+	for _, e := range entries {
+		i := strings.Index(e.Name(), tmpMarker)
+		if i < 0 {
+			continue
+		}
+		owner := e.Name()[i+len(tmpMarker):]
+		j := strings.LastIndex(owner, ".")
+		if j < 0 {
+			continue
+		}
+		pid, err := strconv.Atoi(owner[j+1:])
+		if err != nil || owner[:j] != host || processAlive(pid) {
+			continue
+		}
+		leftovers = append(leftovers, filepath.Join(dir, e.Name()))
+	}
+	return leftovers, nil
+}
+
+// archiveExt is appended to the entry dir for entries stored as a single
+// archive (-archive) rather than an unpacked tree.
+const archiveExt = ".tar"
+
+func archivePath(dir string) string {
+	return dir + archiveExt
+}
+
+// EntryExists reports whether the cache entry dir is in the store, either
+// unpacked, as an archive or as a content addressed index.
+func EntryExists(dir string) (bool, error) {
+	ok, err := IsDir(dir)
+	if ok || err != nil {
+		return ok, err
+	}
+	for _, p := range []string{archivePath(dir), casPath(dir)} {
+		_, err = os.Stat(p)
+		if !os.IsNotExist(err) {
+			return err == nil, err
+		}
+	}
+	return false, nil
+}
+
+// Entry is a cache entry in the store.
+type Entry struct {
+	Key string `json:"key"`
+	// Dir identifies the entry. Unless it is Archived or CAS it's also
+	// where the cached tree is.
+	Dir      string `json:"dir"`
+	Archived bool   `json:"archived"`
+	// Namespace is set by List for entries of a namespace below the
+	// store listed.
+	Namespace string `json:"namespace,omitempty"`
+	// CAS entries are an index of files kept in the shared blob store.
+	CAS bool `json:"cas"`
+	// Size is only known after calling EntrySizes.
+	Size    int64     `json:"size"`
+	Created time.Time `json:"created"`
+	// LastUsed is when the entry was last installed or created.
+	LastUsed time.Time `json:"lastUsed"`
+	// Manifest is nil for entries cached before manifests were recorded.
+	Manifest *Manifest `json:"manifest,omitempty"`
+	// Pinned is that of the manifest, see Cache.Pin.
+	Pinned bool `json:"pinned"`
+
+	// future is set when the times on disk were in the future and
+	// Created and LastUsed were clamped to now, see clampFuture.
+	future bool
+}
+
+func usedPath(dir string) string {
+	return dir + ".used"
+}
+
+// Touch records that the cache entry dir has just been used.
+func Touch(dir string) error {
+	now := time.Now()
+	err := os.Chtimes(usedPath(dir), now, now)
+	if os.IsPermission(err) {
+		// only the owner may set times, but in a shared store anyone
+		// who can write the file may bump them by truncating it
+		var f *os.File
+		f, err = os.OpenFile(usedPath(dir), os.O_WRONLY, 0)
+		if err == nil {
+			err = f.Truncate(0)
+			if errClose := f.Close(); err == nil {
+				err = errClose
+			}
+		}
+	}
+	if os.IsNotExist(err) {
+		var f *os.File
+		f, err = os.Create(usedPath(dir))
+		if err == nil {
+			err = f.Close()
+		}
+	}
+	return err
+}
+
+// IsDir reports whether d is a directory. A missing d is not an error.
+func IsDir(d string) (bool, error) {
+	info, err := os.Stat(d)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return info.IsDir(), nil
+
+}
+
+// Entries returns all entries in cacheStore.
+func Entries(cacheStore string) ([]Entry, error) {
+	dirs, err := os.ReadDir(cacheStore)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []Entry
+	for _, d := range dirs {
+		name := d.Name()
+		if strings.Contains(name, tmpMarker) || name == blobsDir || name == extractedDir {
+			continue
+		}
+		e := Entry{Key: name}
+		switch {
+		case d.IsDir() && isNamespace(filepath.Join(cacheStore, name)):
+			continue
+		case d.IsDir():
+		case d.Type().IsRegular() && strings.HasSuffix(name, archiveExt):
+			e.Key, e.Archived = strings.TrimSuffix(name, archiveExt), true
+		case d.Type().IsRegular() && strings.HasSuffix(name, casExt):
+			e.Key, e.CAS = strings.TrimSuffix(name, casExt), true
+		default:
+			continue
+		}
+		e.Dir = filepath.Join(cacheStore, e.Key)
+
+		info, err := d.Info()
+		if err != nil {
+			return nil, err
+		}
+		e.Created, e.LastUsed = info.ModTime(), info.ModTime()
+
+		info, err = os.Stat(usedPath(e.Dir))
+		if err == nil {
+			e.LastUsed = info.ModTime()
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+
+		e.Manifest, err = ReadManifest(e.Dir)
+		if err != nil {
+			return nil, err
+		}
+		e.Pinned = e.Manifest != nil && e.Manifest.Pinned
+		clampFuture(&e)
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// clockSlack is how far in the future entry times may be before they are
+// taken for clock skew rather than, say, a file server a bit ahead.
+const clockSlack = time.Minute
+
+// warnedFuture are the entries whose future times were warned about, so
+// listing them again stays quiet.
+var (
+	warnedFuture   = map[string]bool{}
+	warnedFutureMu sync.Mutex
+)
+
+// clampFuture sets times of e in the future to now, as left by a machine
+// with its clock ahead. They would otherwise shield e from -max-age and
+// eviction for as long as the clock was off.
+func clampFuture(e *Entry) {
+	now := time.Now()
+	limit := now.Add(clockSlack)
+	if !e.Created.After(limit) && !e.LastUsed.After(limit) {
+		return
+	}
+	warnedFutureMu.Lock()
+	if !warnedFuture[e.Dir] {
+		warnedFuture[e.Dir] = true
+		Progressf("Warning: %s has times in the future (%s) - the clock of whoever cached or used it may be off. Treating it as cached now", e.Key, laterOf(e.Created, e.LastUsed).Format(timeFormat))
+	}
+	warnedFutureMu.Unlock()
+	if e.Created.After(limit) {
+		e.Created = now
+	}
+	if e.LastUsed.After(limit) {
+		e.LastUsed = now
+	}
+	e.future = true
+}
+
+func laterOf(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+// fixFuture resets the times of e on disk to now if clampFuture clamped
+// them, so its age is counted from today on.
+func fixFuture(e Entry) error {
+	if !e.future {
+		return nil
+	}
+	now := time.Now()
+	for _, p := range []string{e.Dir, archivePath(e.Dir), casPath(e.Dir), usedPath(e.Dir)} {
+		err := os.Chtimes(p, now, now)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// RemoveEntry removes the cache entry dir along with everything recorded
+// about it. Blobs of content addressed entries are left for PruneBlobs.
+func RemoveEntry(dir string) error {
+	for _, p := range []string{dir, archivePath(dir), casPath(dir), manifestPath(dir), usedPath(dir), lockPath(dir)} {
+		err := os.RemoveAll(p)
+		if err != nil {
+			return err
+		}
+	}
+	return removeExtracted(extractedPath(dir))
+}
+
+// EntrySizes fills in the size of entries, which takes walking all of them.
+func EntrySizes(entries []Entry) error {
+	for i, e := range entries {
+		var err error
+		switch {
+		case e.CAS:
+			entries[i].Size, err = casSize(e.Dir)
+		case e.Archived:
+			entries[i].Size, err = dirSize(archivePath(e.Dir))
+		default:
+			entries[i].Size, err = dirSize(e.Dir)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		size += info.Size()
+		return nil
+	})
+	return size, err
+}
+
+// NetworkFS returns the name of the network filesystem dir is on, or "" if
+// it's local or that can't be told. A store on one is slow, and locking
+// and atomic renames may not work on it.
+func NetworkFS(dir string) (string, error) {
+	return networkFS(dir)
+}
+
+// CheckNesting fails if one of outputs is inside cacheDir or cacheDir is
+// inside one of them, as copying between them would then recurse into
+// itself. Symlinks along the paths are resolved, but not an output itself
+// as that may be a symlink into the cache installed by an earlier run.
+func CheckNesting(cacheDir string, outputs []string) error {
+	store, err := resolvePath(cacheDir)
+	if err != nil {
+		return err
+	}
+	for _, out := range outputs {
+		abs, err := filepath.Abs(out)
+		if err != nil {
+			return err
+		}
+		parent, err := resolvePath(filepath.Dir(abs))
+		if err != nil {
+			return err
+		}
+		p := filepath.Join(parent, filepath.Base(abs))
+		switch {
+		case within(p, store):
+			return fmt.Errorf("output %s (%s) is inside the cache dir %s", out, p, store)
+		case within(store, p):
+			return fmt.Errorf("cache dir %s is inside the output %s (%s)", store, out, p)
+		}
+	}
+	return nil
+}
+
+// resolvePath returns p made absolute with the symlinks in it resolved,
+// as far as it exists.
+func resolvePath(p string) (string, error) {
+	p, err := filepath.Abs(p)
+	if err != nil {
+		return "", err
+	}
+	var rest []string
+	for {
+		resolved, err := filepath.EvalSymlinks(p)
+		if err == nil {
+			return filepath.Join(append([]string{resolved}, rest...)...), nil
+		}
+		parent := filepath.Dir(p)
+		if !os.IsNotExist(err) || parent == p {
+			return "", err
+		}
+		rest = append([]string{filepath.Base(p)}, rest...)
+		p = parent
+	}
+}
+
+// within reports whether the clean absolute path p is dir or below it.
+func within(p, dir string) bool {
+	rel, err := filepath.Rel(dir, p)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
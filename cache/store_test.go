@@ -0,0 +1,105 @@
+package cache
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// cachedEntry caches an entry in a new store and returns the cache and
+// the entry.
+func cachedEntry(t *testing.T) (*Cache, Entry) {
+	t.Helper()
+	c, spec, dir := testCache(t, InstallSymlink)
+	out := filepath.Join(dir, "out")
+	ensure(t, c, spec, out, helperCmd(t, "write", out, "f"))
+	entries, err := Entries(c.NamespaceDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("got %d entries, want 1", len(entries))
+	}
+	return c, entries[0]
+}
+
+// setTimes sets the times on disk of e to tm.
+func setTimes(t *testing.T, e Entry, tm time.Time) {
+	t.Helper()
+	for _, p := range []string{e.Dir, usedPath(e.Dir)} {
+		err := os.Chtimes(p, tm, tm)
+		if err != nil && !os.IsNotExist(err) {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestFutureEntry(t *testing.T) {
+	c, e := cachedEntry(t)
+	store := c.NamespaceDir()
+	setTimes(t, e, time.Now().Add(365*24*time.Hour))
+
+	entries, err := Entries(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e = entries[0]
+	if time.Since(e.Created) > time.Minute || time.Since(e.LastUsed) > time.Minute {
+		t.Errorf("times of a future entry weren't clamped to now: cached %s, last used %s", e.Created, e.LastUsed)
+	}
+	if !e.future {
+		t.Error("the clamped entry isn't marked as such")
+	}
+
+	// it is as good as cached now, so not old enough to expire...
+	err = Expire(store, time.Hour, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := EntryExists(e.Dir); !ok {
+		t.Fatal("a future entry was expired as if it were old")
+	}
+	// ...and its age counts from now on, rather than a year from now
+	info, err := os.Stat(e.Dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.ModTime().After(time.Now().Add(clockSlack)) {
+		t.Errorf("Expire left the time on disk at %s", info.ModTime())
+	}
+	setTimes(t, e, time.Now().Add(-2*time.Hour))
+	err = Expire(store, time.Hour, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := EntryExists(e.Dir); ok {
+		t.Error("the entry isn't expired once it is old")
+	}
+}
+
+func TestSlightlyFutureEntry(t *testing.T) {
+	c, e := cachedEntry(t)
+	ahead := time.Now().Add(clockSlack / 2).Truncate(time.Second)
+	setTimes(t, e, ahead)
+
+	entries, err := Entries(c.NamespaceDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e := entries[0]; e.future || !e.Created.Equal(ahead) {
+		t.Errorf("an entry within the clock slack was clamped: cached %s, want %s", e.Created, ahead)
+	}
+}
+
+func TestExpireDryRun(t *testing.T) {
+	c, e := cachedEntry(t)
+	setTimes(t, e, time.Now().Add(-2*time.Hour))
+	err := Expire(c.NamespaceDir(), time.Hour, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := EntryExists(e.Dir); !ok {
+		t.Error("a dry run removed the expired entry")
+	}
+}
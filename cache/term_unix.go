@@ -0,0 +1,11 @@
+//go:build !windows
+
+package cache
+
+import "os"
+
+// isTerminal reports whether f is a terminal.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
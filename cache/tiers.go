@@ -0,0 +1,203 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// StoreRemote is a Remote backed by another store on a reachable
+// filesystem, e.g. a large shared one behind a fast local Cache.Dir. Keys
+// are namespaced as for any Remote, so the entries are laid out as in the
+// store of a Cache with the same Namespace, and lookups find those cached
+// there directly.
+type StoreRemote struct {
+	Dir string
+	// Archive keeps entries Put into the store as archives, as
+	// Cache.Archive does.
+	Archive bool
+	// ReadOnly leaves the store as it is: Get doesn't record the use of
+	// entries, Put fails with ErrReadOnly and a Tiered doesn't copy hits
+	// into it. See Cache.ReadOnly.
+	ReadOnly bool
+}
+
+func (r *StoreRemote) String() string {
+	return r.Dir
+}
+
+func (r *StoreRemote) entry(key string) string {
+	return filepath.Join(r.Dir, filepath.FromSlash(key))
+}
+
+// Get archives the entry for key to dst, uncompressed as it is copied
+// on the same host. Archived entries are copied as they are.
+func (r *StoreRemote) Get(key, dst string) error {
+	dir := r.entry(key)
+	ok, err := EntryExists(dir)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("%s: %w", key, ErrCacheMiss)
+	}
+	if !r.ReadOnly {
+		// a hit here keeps the entry from being evicted as unused
+		Touch(dir)
+	}
+	if _, err := os.Stat(archivePath(dir)); err == nil {
+		return copyArchive(archivePath(dir), dst)
+	}
+	return writeEntryArchive(dst, CompressNone, dir)
+}
+
+// Put adds the archive src as the entry for key, unless the store has it
+// or another process is adding it.
+func (r *StoreRemote) Put(key, src string) error {
+	if r.ReadOnly {
+		return ErrReadOnly
+	}
+	dir := r.entry(key)
+	err := os.MkdirAll(filepath.Dir(dir), DirMode)
+	if err != nil {
+		return err
+	}
+	lock, err := TryLockEntry(dir)
+	if err == ErrLocked {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+	if ok, err := EntryExists(dir); ok || err != nil {
+		return err
+	}
+
+	tmp := tmpDir(dir)
+	if r.Archive {
+		tmp += archiveExt
+		err := copyArchive(src, tmp)
+		if err != nil {
+			os.Remove(tmp)
+			return err
+		}
+		return CommitArchive(tmp, dir)
+	}
+	err = extractArchiveFile(src, tmp)
+	if err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+	return CommitDir(tmp, dir)
+}
+
+// copyArchive copies the archive src to dst.
+func copyArchive(src, dst string) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	return copyFile(src, dst, info, false)
+}
+
+// Tier is one of the Remotes of a Tiered.
+type Tier struct {
+	Remote
+	// NoPut leaves the tier out when Putting new entries. Entries found in
+	// later tiers are still copied into it.
+	NoPut bool
+}
+
+// Tiered is a Remote over several, e.g. StoreRemotes falling back to a
+// remote cache, tried in order on Get. A hit in one is copied into those
+// before it, so it is found sooner next time, unless they are ReadOnly
+// StoreRemotes. Put adds new entries to all tiers but the NoPut ones.
+type Tiered []Tier
+
+func (t Tiered) String() string {
+	names := make([]string, len(t))
+	for i, r := range t {
+		names[i] = r.String()
+	}
+	return strings.Join(names, ", ")
+}
+
+// Get tries each tier in turn. Failures other than misses are reported
+// and the next tier is tried, ErrCacheMiss is returned if none has key.
+func (t Tiered) Get(key, dst string) error {
+	for i, r := range t {
+		err := r.Get(key, dst)
+		if errors.Is(err, ErrCacheMiss) {
+			continue
+		}
+		if err != nil {
+			Progressf("Can't fetch from %s: %v", r, err)
+			continue
+		}
+		Progressf("Found %s in %s", key, r)
+		for _, earlier := range t[:i] {
+			if s, ok := earlier.Remote.(*StoreRemote); ok && s.ReadOnly {
+				continue
+			}
+			err := earlier.Put(key, dst)
+			if err != nil {
+				Progressf("Can't copy %s into %s: %v", key, earlier, err)
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("%s: %w", key, ErrCacheMiss)
+}
+
+// Put sends src to each tier but the NoPut ones, failing with the first
+// error after trying all of them.
+func (t Tiered) Put(key, src string) error {
+	var first error
+	for _, r := range t {
+		if r.NoPut {
+			continue
+		}
+		err := r.Put(key, src)
+		if err != nil && first == nil {
+			first = fmt.Errorf("%s: %w", r, err)
+		}
+	}
+	return first
+}
+
+// putsAny reports whether Put on r sends entries anywhere. Only a Tiered
+// with nothing but NoPut tiers doesn't.
+func putsAny(r Remote) bool {
+	t, ok := r.(Tiered)
+	if !ok {
+		return true
+	}
+	for _, r := range t {
+		if !r.NoPut {
+			return true
+		}
+	}
+	return false
+}
+
+// readOnlyRemote returns r reading from the StoreRemotes in it without
+// writing to them, for Cache.ReadOnly. Other Remotes are only read from
+// by Get anyway.
+func readOnlyRemote(r Remote) Remote {
+	switch r := r.(type) {
+	case *StoreRemote:
+		ro := *r
+		ro.ReadOnly = true
+		return &ro
+	case Tiered:
+		ro := make(Tiered, len(r))
+		for i, t := range r {
+			ro[i] = Tier{Remote: readOnlyRemote(t.Remote), NoPut: t.NoPut}
+		}
+		return ro
+	}
+	return r
+}
@@ -0,0 +1,82 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Warm makes sure there is an entry for k, generating it with cmd if
+// needed, without installing it. Outputs that exist are moved aside while
+// cmd runs and put back afterwards. It reports whether the entry was
+// cached already.
+func (c *Cache) Warm(k KeySpec, outputs, cmd []string) (hit bool, err error) {
+	if len(outputs) == 0 || len(cmd) == 0 {
+		return false, errors.New("no outputs or command given")
+	}
+	if c.ReadOnly {
+		return false, ErrReadOnly
+	}
+
+	start := time.Now()
+	keys, err := c.keys(k)
+	if err != nil {
+		return false, fmt.Errorf("can't hash dependency description: %w", err)
+	}
+	depDir, cached, lock, err := c.find(keys, k)
+	if err != nil {
+		return false, err
+	}
+	if lock != nil {
+		defer lock.Unlock()
+	}
+	if cached {
+		c.emit(&HitEvent{Key: filepath.Base(depDir), Entry: depDir, Outputs: outputs, Lookup: time.Since(start)})
+		Progress("Already cached - nothing to warm")
+		return true, nil
+	}
+
+	c.emit(&MissEvent{Key: filepath.Base(depDir), Entry: depDir, Outputs: outputs, Lookup: time.Since(start)})
+	if !c.SkipCommandCheck {
+		err := checkCommand(cmd[0], c.RunDir)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	aside := make([]string, len(outputs))
+	defer func() {
+		for i, out := range outputs {
+			errRm := os.RemoveAll(out)
+			if aside[i] != "" {
+				errRm = os.Rename(aside[i], out)
+			}
+			if errRm != nil && err == nil {
+				err = errRm
+			}
+		}
+	}()
+	for i, out := range outputs {
+		if _, err := os.Lstat(out); err != nil {
+			continue
+		}
+		aside[i] = tmpDir(out)
+		err := os.Rename(out, aside[i])
+		if err != nil {
+			aside[i] = ""
+			return false, fmt.Errorf("moving %s aside: %w", out, err)
+		}
+	}
+
+	exitCode, err := c.miss(depDir, k, outputs, cmd)
+	if err != nil {
+		return false, err
+	}
+	Progress("Cache warmed")
+	if exitCode != 0 {
+		return false, &AcceptedExitError{Code: exitCode}
+	}
+	return false, nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+
+	"gopkg.in/yaml.v2"
+)
+
+// configFile is read from the current dir when -config isn't given.
+const configFile = ".cache-pkgs.yaml"
+
+// Config holds defaults for a run, typically committed to a repo as
+// .cache-pkgs.yaml:
+//
+//	deps: [package.json, package-lock.json]
+//	out: node_modules
+//	command: [npm, ci]
+//	hash: sha256
+//	cache-dir: /var/cache/deps
+//	remote: s3://bucket/ci
+//	namespace: frontend
+//	key-version: 2
+type Config struct {
+	Deps       yamlList `yaml:"deps"`
+	Out        yamlList `yaml:"out"`
+	Command    yamlList `yaml:"command"`
+	CacheDir   string   `yaml:"cache-dir"`
+	Hash       string   `yaml:"hash"`
+	Remote     string   `yaml:"remote"`
+	Namespace  string   `yaml:"namespace"`
+	KeyVersion int      `yaml:"key-version"`
+}
+
+// yamlList is a list that may be written as a single string.
+type yamlList []string
+
+func (l *yamlList) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err == nil {
+		*l = yamlList{s}
+		return nil
+	}
+	return unmarshal((*[]string)(l))
+}
+
+// LoadConfig reads the config at p. With p empty configFile is read if it
+// exists, otherwise the zero Config is returned.
+func LoadConfig(p string) (*Config, error) {
+	explicit := p != ""
+	if !explicit {
+		p = configFile
+	}
+	b, err := os.ReadFile(p)
+	if os.IsNotExist(err) && !explicit {
+		return &Config{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Config{}
+	err = yaml.UnmarshalStrict(b, c)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", p, err)
+	}
+	return c, nil
+}
+
+// applyFlags sets the flags c has values for, unless they were given on
+// the command line.
+func (c *Config) applyFlags() error {
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	// -store replaces it
+	set["cache-dir"] = set["cache-dir"] || set["store"]
+
+	keyVersion := ""
+	if c.KeyVersion != 0 {
+		keyVersion = strconv.Itoa(c.KeyVersion)
+	}
+	for name, v := range map[string]string{
+		"cache-dir":   c.CacheDir,
+		"hash":        c.Hash,
+		"remote":      c.Remote,
+		"namespace":   c.Namespace,
+		"key-version": keyVersion,
+	} {
+		if v == "" || set[name] {
+			continue
+		}
+		err := flag.Set(name, v)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
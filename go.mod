@@ -0,0 +1,10 @@
+module github.com/stengaard/cache-pkgs
+
+go 1.26.0
+
+require (
+	github.com/klauspost/compress v1.20.1
+	golang.org/x/crypto v0.57.0
+	golang.org/x/sys v0.48.0
+	gopkg.in/yaml.v2 v2.4.0
+)
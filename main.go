@@ -1,5 +1,5 @@
 // Command cache-pkgs caches pacakge directories based on the hash of
-// dependency specification file. Unix only.
+// dependency specification file.
 //
 //     Usage:
 //        cache-pkgs [opts] <dep-spec-file> <dir> <cmd> [args..]
@@ -17,266 +17,1115 @@
 //       -f	Force remove existing output directory
 //       -symlink
 //         	Use a symlink instead of copy (default true)
+//
+// The cache key is the hash of the dependency specification file(s). With
+// -key-includes-cmd the command and its arguments are hashed along with
+// it, so e.g. switching from `npm install` to `npm ci` gives a fresh cache
+// entry instead of reusing the one built by the other command. Each -key-env
+// variable adds its name and value (or that it is unset) to the key, and
+// each -key-tool command its output, e.g. the version of the toolchain. With
+// -normalize the spec files are hashed in a canonical form, so reformatting
+// them keeps the key. Directories given as specs are hashed as a tree, with
+// symlinks in them hashed by where they point unless -follow-symlinks is
+// given; a link to a dir it is in is then still hashed by where it points,
+// so cycles end. Spec files which are symlinks are hashed by what they
+// point to, or with -no-follow-spec by where.
+//
+// A command producing several directories (e.g. node_modules and a build
+// dir) can cache them together by giving each with -out instead of the
+// <dir> argument. They are generated by one run, cached as a single entry
+// and installed together on a hit.
+//
+// The caching is done by package github.com/stengaard/cache-pkgs/cache,
+// this command only maps flags onto it.
 package main
 
 import (
-	"crypto/sha1"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
-	"io"
 	"os"
 	"os/exec"
-	"os/user"
 	"path"
 	"path/filepath"
+	"runtime"
+	"strconv"
 	"strings"
 	"time"
+
+	"github.com/stengaard/cache-pkgs/cache"
 )
 
 var (
-	symlink    = flag.Bool("symlink", true, "Use a symlink instead of copy")
-	force      = flag.Bool("f", false, "Force remove existing output directory")
-	clean      = flag.Bool("clean", false, "Clean cache and exit")
-	invalidate = flag.String("invalidate", "", "Invalidate the cache for [file]")
+	symlink       = flag.Bool("symlink", true, "Use a symlink instead of copy")
+	autoStrategy  = flag.Bool("auto-strategy", false, "Copy instead of symlinking when the cache dir and output are on different filesystems")
+	subpath       = flag.String("install-subpath", "", "Install only the `path` subdir of the output, leaving the rest of it in the cache entry. A generated output is cut down to it too")
+	relSymlink    = flag.Bool("no-symlink-abs", false, "Make -symlink links relative to the output dir, so they survive moving the cache dir and output together")
+	hardlink      = flag.Bool("hardlink", false, "Recreate the directories and hardlink the files instead of symlink or copy")
+	force         = flag.Bool("f", false, "Force remove existing output directory")
+	lazyCopy      = flag.Bool("lazy-copy", false, "Experimental: symlink a cached output as usual, then copy the entry in the background and swap the copy in for the link once done, so later changes to the output don't reach the cache. If the copy fails the symlink stays, with a warning")
+	idempotent    = flag.Bool("idempotent", false, "Replace an output symlinked to another cache entry, e.g. after the dependency description changed, instead of failing without -f. On a hit the new link replaces the old one atomically. Outputs already linking to the entry are always left alone, real dirs still need -f")
+	clean         = flag.Bool("clean", false, "Clean cache and exit")
+	migrateHash   = flag.Bool("migrate-hash", false, "Rekey the entries cached with another hash algorithm than -hash, e.g. after switching to it, then exit. That works as long as their dependency description files are unchanged; the others are reported as orphans, see -prune-orphans. Honors -dry-run")
+	pruneOrphans  = flag.Bool("prune-orphans", false, "With -migrate-hash remove the entries which couldn't be rekeyed, as nothing will hit them any more")
+	gc            = flag.Bool("gc", false, "Tidy the cache and exit: remove leftovers of crashed runs and the entries -max-age and -max-size select, reporting the space reclaimed")
+	invalidate    = flag.String("invalidate", "", "Invalidate the cache for [file] (comma separated for several). Trailing args are the command for -key-includes-cmd")
+	hashAlgo      = flag.String("hash", "sha256", "Hash algorithm for the dependency description: "+cache.HashAlgoNames())
+	noMtime       = flag.Bool("no-mtime-shortcut", false, "Always hash the dependency description files, rather than trusting an unchanged size and modification time")
+	normalize     = flag.String("normalize", "", "Normalize the dependency description files before hashing: "+cache.NormalizeJSON+" (canonical JSON) or "+cache.NormalizeWhitespace+" (no trailing whitespace, LF newlines). Changes the cache key")
+	noFollowSpec  = flag.Bool("no-follow-spec", false, "Hash dependency description files which are symlinks by where they point rather than by what they point to, e.g. for a package.json linked to a shared one in a monorepo. Changes the cache key")
+	followLinks   = flag.Bool("follow-symlinks", false, "Hash what symlinks in dependency description dirs point to, not just where. Links back to a dir they are in are hashed as links. Changes the cache key")
+	keyCmd        = flag.Bool("key-includes-cmd", false, "Include the command and its args in the cache key")
+	lockTimeout   = flag.Duration("lock-timeout", 0, "Give up waiting for another process generating the same cache entry after this long (0 waits forever)")
+	extractCache  = flag.String("extract-cache", "", "Install -archive entries from a copy extracted into the cache dir on first use, so they can be symlinked, keeping up to `size` (e.g. 10GB) of extracted copies. Least recently used ones are removed beyond that")
+	maxSize       = flag.String("max-size", "", "Evict least recently used entries once the cache grows beyond this `size` (e.g. 5GB)")
+	keyVersion    = flag.Int("key-version", 0, "Mix `n` into the cache key. Bumping it gives all entries new keys, see above")
+	salt          = flag.String("salt", "", "Mix `salt` into the cache key, giving a key space of its own within the cache dir. Defaults to $"+cache.SaltEnv+". This isolates caches from each other, it doesn't secure them")
+	copyCmd       = flag.String("copy-cmd", "", "Copy trees with `command` rather than natively, e.g. 'rsync -a "+cache.CopySrc+"/ "+cache.CopyDst+"'. "+cache.CopySrc+" and "+cache.CopyDst+" are replaced by the paths, the command is split on spaces")
+	copyPar       = flag.Int("copy-parallelism", runtime.NumCPU(), "Copy or hardlink up to `n` files at once when copying trees")
+	since         = flag.String("since", "", "With -list only show entries created or used within `duration` (e.g. 1h, 2d), most recent first")
+	maxAge        = flag.String("max-age", "", "Treat entries cached longer than `duration` ago (e.g. 30d, 12h) as misses and remove them. With -clean only those are removed, with -dry-run they are listed instead")
+	list          = flag.Bool("list", false, "List the cached entries and exit")
+	asJSON        = flag.Bool("json", false, "Print -print-key, -list, -stats, -size and -show output as JSON, versioned by its schemaVersion field. Unlike the text output it is kept compatible within a version, see the README")
+	size          = flag.Bool("size", false, "Print the number of entries, total size, largest entries and free space of the cache, then exit")
+	stats         = flag.Bool("stats", false, "Print the hit rate, time saved by hits and size of the cache, then exit")
+	verify        = flag.Bool("verify", false, "Record a digest of new cache entries and check it before installing, regenerating on mismatch")
+	asyncPush     = flag.Bool("async-push", false, "Push new entries to -remote in the background, installing them without waiting on the upload. The run still waits for it before exiting, for up to -push-wait")
+	pushWait      = flag.Duration("push-wait", 10*time.Minute, "How long to wait at exit for -async-push uploads to finish before giving up on them (0 waits forever)")
+	remoteTimeout = flag.Duration("remote-timeout", cache.RemoteTimeout, "Give up on a request to -remote, downloads and uploads included, after this long and generate the entry locally instead (0 waits forever)")
+	remoteURL     = flag.String("remote", "", "Pull missing entries from and push new ones to the remote cache at `url` (s3://bucket/prefix or http(s)://host/path). http(s) remotes are sent $"+cache.TokenEnv+" as bearer token")
+	archive       = flag.Bool("archive", false, "Store new cache entries as a single archive, extracted on install, instead of an unpacked tree")
+	compress      = flag.String("compress", cache.CompressGzip, "Compression of -archive entries and remote uploads: "+cache.CompressNone+", "+cache.CompressGzip+" or "+cache.CompressZstd+". Installing detects it by itself")
+	cas           = flag.Bool("cas", false, "Store new cache entries content addressed, keeping files shared between entries once and installing them as hardlinks. Changes the on-disk layout of the store")
+	statusFile    = flag.String("status-file", "", "Write \"hit\" or \"miss\" to `file` depending on whether the output was served from the cache")
+	missExitCode  = flag.Int("miss-exit-code", 0, "Exit `code` to use when the output had to be generated")
+	quiet         = flag.Bool("quiet", false, "Only print errors")
+	verbose       = flag.Bool("verbose", false, "Print timings of each step")
+	timings       = flag.Bool("timings", false, "Print how long hashing, waiting for the lock, fetching from -remote, installing, running the command and copying into the cache took once each entry is done, and with -log-format json add them to its done event")
+	acceptExit    = flag.String("accept-exit-codes", "0", "Comma separated exit `codes` of the command to cache the output for. The command's exit code is still passed on")
+	pinKey        = flag.String("pin", "", "Pin the cache entry `key`, so -max-size and -max-age never remove it, then exit. -list shows which entries are pinned")
+	unpinKey      = flag.String("unpin", "", "Unpin the cache entry `key`, see -pin, then exit")
+	exportKey     = flag.String("export", "", "Write the cache entry `key` to the file given as argument and exit, for -import on another machine")
+	importFile    = flag.String("import", "", "Add the cache entry in the -export `file` to the cache and exit")
+	merge         = flag.Bool("merge", false, "Install over an existing output dir, replacing cached paths and keeping anything else in it. Copies unless -hardlink is given, can't be combined with -symlink")
+	warm          = flag.Bool("warm", false, "Only make sure the entry is cached, generating it if needed, without installing it to the output dir")
+	checkCmd      = flag.Bool("check-cmd", true, "Check that the command is in PATH before generating a missing entry")
+	postInstall   = flag.String("post-install", "", "Run `cmd` (split on spaces) after installing a cached entry, failing the run if it fails")
+	preGenerate   = flag.String("pre-generate", "", "Run `cmd` (split on spaces) before generating a missing entry, failing the run if it fails")
+	retries       = flag.Int("retries", 0, "Rerun a failing command up to `n` times, with exponential backoff starting at 1s")
+	cmdTimeout    = flag.Duration("timeout", 0, "Stop the command if it runs longer than `duration`, removing its partial output (0 waits forever)")
+	runDir        = flag.String("run-dir", "", "Run the command in `dir`, while the spec files, outputs and everything else are still looked up from the current dir. The outputs should be given as the command creates them relative to that, e.g. -run-dir packages/web packages/web/node_modules")
+	workDir       = flag.String("cwd", "", "Run in `dir`: the command runs there and the config, spec files, outputs and a relative cache dir are looked up from it")
+	configPath    = flag.String("config", "", "Read defaults from the YAML config `file` (default "+configFile+" if present)")
+	storeWrite    = flag.String("store-write", "first", "Which -store dirs new entries are written to: first or all. Entries found in a later one are copied into those before it either way")
+	cacheDirFlag  = flag.String("cache-dir", "", "Keep the cache in `dir`. Defaults to $CACHE_DIR, or ~/.dep-cache if that is unset")
+	readOnly      = flag.Bool("read-only", false, "Never write to the cache dir or push to -remote: hits are installed, misses generate the output without caching it. Store maintenance like -max-age is skipped")
+	namespace     = flag.String("namespace", "", "Keep entries in the `name` subdir of the cache dir, isolating them from other namespaces. -clean, -list, -stats and eviction then only cover that namespace, while -list without it shows all of them")
+	specCmd       = flag.String("spec-cmd", "", "Hash the output of `cmd` (split on spaces), e.g. \"pip freeze\", instead of dependency description files. It runs once before anything else and a failure aborts the run. Replaces <dep-spec-file>")
+	cacheMode     = flag.String("cache-mode", "0750", "Octal `mode` of the dirs created in the cache dir, the cache dir itself and the root dir of each entry, regardless of the umask. E.g. 0755 to share the cache with other users")
+	sharedGroup   = flag.Bool("shared-group", false, "Share the cache dir with the users of its group: dirs are created group writable and setgid (mode 2770 unless -cache-mode is given) and the umask is set to 002, so entries, locks and what the command generates are usable by them. See the recipe above")
+	doctor        = flag.Bool("doctor", false, "Check that the cache dir, linking and copying into the current dir, free space and the -remote work, then exit. Fails if one of them would break runs")
+	fixedKey      = flag.String("key", "", "Use `key` as the cache key instead of hashing anything, e.g. to install a known good entry while bisecting. A miss fails unless a command is given to generate it. Replaces <dep-spec-file>")
+	printKey      = flag.Bool("print-key", false, "Print the cache key for the dependency description, outputs and command given, then exit without looking at the cache")
+	show          = flag.String("show", "", "Print the top-level contents, number of files, size and manifest of the cache entry `key`, then exit without installing it. Archived entries aren't extracted for it. With -json as JSON")
+	showSpec      = flag.Bool("show-spec", false, "Like -show for the entry of the dependency description, outputs and command given, as keyed for -print-key")
+	watchCheck    = flag.Bool("watch-check", false, "Check whether the outputs still link to the cache entry for the dependency description, warning about those installed from an older one, then exit")
+	failOnMiss    = flag.Bool("fail-on-miss", false, "Fail instead of running the command if the entry is neither in the cache dir nor the -remote, e.g. in a stage which must only install what an earlier one cached. The command may be left out then")
+	strictLocal   = flag.Bool("strict-local", false, "Fail if the cache dir is on a network filesystem rather than only warning")
+	strict        = flag.Bool("strict", false, "Make -watch-check fail, with exit code 1, if outputs are stale")
+	dryRun        = flag.Bool("dry-run", false, "Print the cache key, whether it is a hit and what would be done, then exit without touching the outputs or the cache or running the command")
+	logFormat     = flag.String("log-format", cache.LogText, "Progress output `format`: "+cache.LogText+" or "+cache.LogJSON+" (one JSON object per event)")
+	preserveOwner = flag.Bool("preserve-owner", false, "Preserve file ownership when copying (needs root)")
+	deps          stringList
+	globs         stringList
+	keyEnv        stringList
+	stores        stringList
+	outs          stringList
+	excludes      stringList
+	rewrites      stringList
+	rewriteFiles  stringList
+	labeled       stringList
+	generates     argList
+	keyTools      argList
 )
 
+func init() {
+	flag.Var(&deps, "dep", "Dependency description `file` (repeatable or comma separated). Replaces <dep-spec-file>")
+	flag.Var(&globs, "glob", "Dependency description `pattern`, \"**\" matches any number of dirs (repeatable). Replaces <dep-spec-file>")
+	flag.Var(&outs, "out", "Output `dir` (repeatable). All outputs are cached together in one entry. Replaces <dir>")
+	flag.Var(&excludes, "exclude", "Leave paths matching `pattern` out of the cached tree (repeatable). Patterns work as in .gitignore: one without a slash matches a name at any depth, others the path from the output dir, \"**\" matching any number of dirs. See also .cacheignore above")
+	flag.Var(&rewrites, "rewrite", "Replace old with new in the installed files matching -rewrite-files, given as `old=new` (repeatable), for tools embedding the absolute path they ran at. Copies unless -hardlink is given, can't be combined with -symlink")
+	flag.Var(&rewriteFiles, "rewrite-files", "Apply -rewrite to the installed files matching `pattern` (repeatable), as for -exclude")
+	flag.Var(&labeled, "output", "Labeled output, given as `label=dir` (repeatable). Each is generated by its -generate command and cached as an entry of its own, keyed by the dependency description and the label, so only missing ones are generated. Replaces <dir> and the command")
+	flag.Var(&keyTools, "key-tool", "Include the output of `cmd` (split on spaces), e.g. 'python --version', in the cache key (repeatable), so entries built with another toolchain aren't reused. Each runs once before anything else and a failure aborts the run")
+	flag.Var(&generates, "generate", "Command generating a labeled -output, given as `label=cmd` with cmd split on spaces (repeatable)")
+	flag.Var(&stores, "store", "Cache store `dir` (repeatable), replacing -cache-dir. Entries missing from the first are looked up in the next ones in order, then in -remote, and copied into those before the one they were found in. New entries go to the first, see -store-write. With -read-only none of them is written to, hits aren't copied into earlier ones. -list, -gc, -max-size and the like only cover the first")
+	flag.Var(&keyEnv, "key-env", "Include the environment variable `name` and its value in the cache key (repeatable)")
+}
+
+// argList is a flag.Value collecting repeated values, which may contain
+// commas.
+type argList []string
+
+func (l *argList) String() string {
+	return strings.Join(*l, " ")
+}
+
+func (l *argList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+// stringList is a flag.Value collecting repeated and comma separated values.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(s string) error {
+	for _, v := range strings.Split(s, ",") {
+		if v != "" {
+			*l = append(*l, v)
+		}
+	}
+	return nil
+}
+
 func usage() {
 	usageStr := `Usage:
    %s [opts] <dep-spec-file> <dir> <cmd> [args..]
+   %s [opts] -dep <file> [-dep <file>..] <dir> <cmd> [args..]
+   %s [opts] -out <dir> [-out <dir>..] <dep-spec-file> <cmd> [args..]
+   %s [opts] -spec-cmd <spec-cmd> <dir> <cmd> [args..]
+   %s [opts] -key <key> <dir> [<cmd> [args..]]
+   %s [opts] -output <label>=<dir> -generate <label>=<cmd> [-output..] <dep-spec-file>
 
 Caches output directory (dir) based on the hash of the dependency
-specification file. If the specification changes the output directory
+specification file(s). If the specification changes the output directory
 is regenerated using cmd and the args. Useful in CI settings.
 
+A dependency specification can also be a directory, in which case the
+whole tree below it is hashed.
+
+The cache lives in the -cache-dir dir if given, else in $CACHE_DIR, else
+in ~/.dep-cache.
+
+Defaults for the spec files (deps), outputs (out), command, cache-dir, hash,
+remote, namespace and key-version can be kept in a YAML config, see
+-config. Flags override it, and any positional args replace its deps, out
+and command.
+
+Patterns given with -glob are expanded by %s itself, not the shell, so
+quote them. Each pattern must match at least one file.
+
+The command is run with $%s set to the cache key and
+$%s to the cache dir the entry is stored in.
+
+If the command fails %s exits with its exit code, %d is reserved for
+failures of %s itself.
+
+A .cacheignore file at the root of an output dir lists paths to leave
+out of the cache, in .gitignore syntax. -exclude patterns are applied
+after it, so they take precedence. The file itself is never cached.
+
+To invalidate all entries, e.g. when rolling out a new -exclude or
+-normalize policy, bump -key-version (or key-version in the config). Unlike
+-clean this leaves the old entries in place, for -max-age and -max-size to
+evict, and runs still on the old version keep hitting them meanwhile.
+
+To share a cache dir between users, e.g. CI jobs running as different
+users on one host, put them in a group and give it the cache dir, then pass
+-shared-group on every run:
+   mkdir /var/cache/pkgs && chgrp builders /var/cache/pkgs
+   chmod 2770 /var/cache/pkgs
+Runs of all of them then hit the same entries and wait on each other's
+locks. Entries created before need fixing up with chgrp -R and chmod -R g+rwX.
+
+Progress is colored when stderr is a terminal, unless $NO_COLOR is set.
+
 Example:
    %s package.json node_modules npm install
 
 Options can be:
 `
 	me := filepath.Base(os.Args[0])
-	fmt.Fprintf(os.Stderr, usageStr, me, me)
+	fmt.Fprintf(os.Stderr, usageStr, me, me, me, me, me, me, me, cache.KeyEnv, cache.DirEnv, me, exitInternal, me, me)
 	flag.PrintDefaults()
 }
 
 func main() {
+	if outs := os.Getenv(lazyCopyEnv); outs != "" {
+		materialize(filepath.SplitList(outs))
+		return
+	}
 	flag.Usage = usage
 	flag.Parse()
 
-	cacheStore, err := cacheDir("")
+	// before anything can fail, so errors are reported in the -log-format
+	if *logFormat != cache.LogText && *logFormat != cache.LogJSON {
+		exitUsage("unknown -log-format ", *logFormat)
+	}
+	cache.Log = &cache.Logger{W: os.Stderr, Format: *logFormat, Quiet: *quiet, Verbose: *verbose, Timings: *timings, Color: cache.ColorTerminal(os.Stderr)}
+
+	if *workDir != "" {
+		// before anything resolves a relative path
+		err := os.Chdir(*workDir)
+		if err != nil {
+			exitWith("Can't change to the -cwd dir: ", err)
+		}
+	}
+
+	conf, err := LoadConfig(*configPath)
 	if err != nil {
-		exitWith("Cache dir problems: ", err)
+		exitWith("Error reading config: ", err)
+	}
+	err = conf.applyFlags()
+	if err != nil {
+		exitUsage("Error in config: ", err)
 	}
 
-	if *clean {
-		fmt.Printf("Wiping cache %q\n", cacheStore)
-		err := os.RemoveAll(cacheStore)
+	if *quiet && *verbose {
+		exitUsage("-quiet and -verbose are mutually exclusive")
+	}
+	if *namespace != "" {
+		err := cache.ValidNamespace(*namespace)
 		if err != nil {
-			exitWith(err)
+			exitUsage(err)
+		}
+	}
+	if *readOnly && (*clean || *gc || *invalidate != "" || *importFile != "" || *warm || *migrateHash || *pruneOrphans) {
+		exitUsage("-read-only can't be combined with -clean, -gc, -invalidate, -import, -warm, -migrate-hash or -prune-orphans")
+	}
+	for _, p := range excludes {
+		if _, err := path.Match(p, ""); err != nil {
+			exitUsage("bad -exclude pattern ", p)
 		}
-		return
+	}
+	if *subpath != "" {
+		if !filepath.IsLocal(*subpath) {
+			exitUsage("-install-subpath must be a relative path inside the output: ", *subpath)
+		}
+		*subpath = path.Clean(filepath.ToSlash(*subpath))
+		if *subpath == "." {
+			*subpath = ""
+		}
+	}
+	var rewriteList []cache.Rewrite
+	for _, s := range rewrites {
+		r, err := cache.ParseRewrite(s)
+		if err != nil {
+			exitUsage(err)
+		}
+		rewriteList = append(rewriteList, r)
+	}
+	if len(rewrites) > 0 != (len(rewriteFiles) > 0) {
+		exitUsage("-rewrite and -rewrite-files go together")
+	}
+	for _, p := range rewriteFiles {
+		if _, err := path.Match(p, ""); err != nil {
+			exitUsage("bad -rewrite-files pattern ", p)
+		}
+	}
+	if *archive && *cas {
+		exitUsage("-archive and -cas are mutually exclusive")
+	}
+	if *runDir != "" {
+		if ok, err := cache.IsDir(*runDir); err != nil || !ok {
+			exitUsage("-run-dir ", *runDir, " is not a directory")
+		}
+	}
+	if *warm && *failOnMiss {
+		exitUsage("-warm generates missing entries, it can't be combined with -fail-on-miss")
+	}
+	if *preserveOwner && os.Geteuid() != 0 {
+		cache.Progress("Not running as root, ignoring -preserve-owner")
+		*preserveOwner = false
 	}
 
-	if *invalidate != "" {
-		h, err := hashFile(*invalidate)
-		if err == nil {
-			err = os.RemoveAll(path.Join(cacheStore, h))
+	c := &cache.Cache{
+		Hash:      *hashAlgo,
+		Namespace: *namespace,
+		InstallOptions: cache.InstallOptions{
+			Mode:          installMode(),
+			PreserveOwner: *preserveOwner,
+			Merge:         *merge,
+
+			RelativeSymlink: *relSymlink,
+			AutoStrategy:    *autoStrategy,
+			Subpath:         *subpath,
+			Rewrite:         rewriteList,
+			RewriteFiles:    rewriteFiles,
+		},
+		Archive:     *archive,
+		Compression: *compress,
+		CAS:         *cas,
+		Verify:      *verify,
+		Force:       *force,
+		Idempotent:  *idempotent,
+		AsyncPush:   *asyncPush,
+		LockTimeout: *lockTimeout,
+		Timeout:     *cmdTimeout,
+		Retries:     *retries,
+
+		MtimeShortcut:    !*noMtime,
+		ReadOnly:         *readOnly,
+		SkipCommandCheck: !*checkCmd,
+		FailOnMiss:       *failOnMiss,
+		RunDir:           *runDir,
+		PreGenerate:      strings.Fields(*preGenerate),
+		PostInstall:      strings.Fields(*postInstall),
+	}
+
+	for _, s := range strings.Split(*acceptExit, ",") {
+		code, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil {
+			exitUsage("bad -accept-exit-codes: ", err)
+		}
+		if code != 0 {
+			c.AcceptExitCodes = append(c.AcceptExitCodes, code)
+		}
+	}
+
+	if *maxSize != "" {
+		c.MaxSize, err = cache.ParseSize(*maxSize)
+		if err != nil {
+			exitUsage(err)
+		}
+	}
+	if *extractCache != "" {
+		c.ExtractCacheSize, err = cache.ParseSize(*extractCache)
+		if err != nil {
+			exitUsage(err)
+		}
+	}
+
+	var maxAgeDur time.Duration
+	if *maxAge != "" {
+		maxAgeDur, err = cache.ParseAge(*maxAge)
+		if err != nil {
+			exitUsage(err)
+		}
+	}
+
+	mode, err := strconv.ParseUint(*cacheMode, 8, 32)
+	if err != nil || mode > 0777 {
+		exitUsage("bad -cache-mode ", *cacheMode, ", want octal permissions like 0755")
+	}
+	cache.DirMode = os.FileMode(mode)
+	if *sharedGroup {
+		if flagSet("cache-mode") {
+			cache.DirMode |= os.ModeSetgid
+		} else {
+			cache.DirMode = cache.SharedDirMode
+		}
+		cache.ShareWithGroup()
+	}
+
+	if *keyVersion < 0 {
+		exitUsage("-key-version must not be negative")
+	}
+
+	if *copyPar < 1 {
+		exitUsage("-copy-parallelism must be at least 1")
+	}
+	cache.CopyParallelism = *copyPar
+	cache.RemoteTimeout = *remoteTimeout
+	if *copyCmd != "" {
+		cache.CopyCmd, err = cache.ParseCopyCmd(*copyCmd)
+		if err != nil {
+			exitUsage(err)
+		}
+	}
+
+	if !flagSet("salt") {
+		*salt = os.Getenv(cache.SaltEnv)
+	}
+
+	var sinceDur time.Duration
+	if *since != "" {
+		if !*list {
+			exitUsage("-since only goes with -list")
+		}
+		sinceDur, err = cache.ParseAge(*since)
+		if err != nil {
+			exitUsage(err)
+		}
+	}
+
+	if *lazyCopy && installMode() != cache.InstallSymlink {
+		exitUsage("-lazy-copy symlinks first, it can't be combined with -symlink=false, -hardlink, -merge or -rewrite")
+	}
+
+	if len(stores) > 0 {
+		if flagSet("cache-dir") {
+			exitUsage("-store replaces -cache-dir, give that as the first -store")
+		}
+		*cacheDirFlag = stores[0]
+	}
+	if *storeWrite != "first" && *storeWrite != "all" {
+		exitUsage("bad -store-write ", *storeWrite, ", want first or all")
+	}
+
+	if *pinKey != "" && *unpinKey != "" {
+		exitUsage("-pin and -unpin are mutually exclusive")
+	}
+
+	if *pruneOrphans && !*migrateHash {
+		exitUsage("-prune-orphans only goes with -migrate-hash")
+	}
+
+	if err := cache.CheckCompression(*compress); err != nil {
+		exitUsage(err)
+	}
+
+	var specOut []byte
+	if *fixedKey != "" && (len(deps) > 0 || len(globs) > 0 || *specCmd != "") {
+		exitUsage("-key replaces the dependency description, it can't be combined with -dep, -glob or -spec-cmd")
+	}
+	if *specCmd != "" {
+		if len(deps) > 0 || len(globs) > 0 {
+			exitUsage("-spec-cmd replaces the dependency description files, it can't be combined with -dep or -glob")
 		}
+		specOut, err = cache.RunSpecCmd(strings.Fields(*specCmd))
 		if err != nil {
 			exitWith(err)
 		}
+	}
+	var tools []cache.ToolOutput
+	if len(keyTools) > 0 {
+		var cmds [][]string
+		for _, t := range keyTools {
+			if len(strings.Fields(t)) == 0 {
+				exitUsage("empty -key-tool command")
+			}
+			cmds = append(cmds, strings.Fields(t))
+		}
+		tools, err = cache.RunKeyTools(cmds)
+		if err != nil {
+			exitWith(err)
+		}
+	}
 
-		return
+	// entries to -show, once the cache dir is known
+	var shows []shownKey
+	if *show != "" {
+		shows = append(shows, shownKey{"", *show})
 	}
 
-	if flag.NArg() < 3 {
-		exitUsage("please supply both dependency description file, outputdir and the command to generate it")
+	if *printKey || *showSpec {
+		specs, outputs, args := resolveArgs(conf)
+		if len(specs) == 0 && specOut == nil && *fixedKey == "" {
+			exitUsage("-print-key and -show-spec need the dependency description file")
+		}
+		k := cache.KeySpec{Files: specs, Env: keyEnv, Tools: tools, Outputs: outputs, Normalize: *normalize, FollowSymlinks: *followLinks, NoFollowSpecs: *noFollowSpec, Exclude: excludes, Salt: *salt, Version: *keyVersion, Key: *fixedKey}
+		if specOut != nil {
+			k.SpecCmd, k.SpecOutput = strings.Fields(*specCmd), specOut
+		}
+		if *keyCmd {
+			k.Cmd = args
+		}
+		var printed []shownKey
+		if units := labeledUnits(outputs, args); units != nil {
+			for _, u := range units {
+				k.Outputs, k.Label = u.outs, u.label
+				if *keyCmd {
+					k.Cmd = u.cmd
+				}
+				keys, err := k.Keys(c.Hash)
+				if err != nil {
+					exitWith(err)
+				}
+				printed = append(printed, shownKey{u.label, keys[0]})
+			}
+		} else {
+			keys, err := k.Keys(c.Hash)
+			if err != nil {
+				exitWith(err)
+			}
+			printed = append(printed, shownKey{"", keys[0]})
+		}
+		if *showSpec {
+			shows = append(shows, printed...)
+		} else {
+			printKeys(c.Hash, printed)
+			return
+		}
 	}
 
-	depDesc := flag.Arg(0)
-	outputdir := flag.Arg(1)
-	cmd := flag.Args()[2]
-	args := flag.Args()[3:]
+	if *remoteURL != "" {
+		c.Remote, err = cache.NewRemote(*remoteURL)
+		if err != nil {
+			exitUsage(err)
+		}
+	}
+	if len(stores) > 1 {
+		var tiers cache.Tiered
+		for _, dir := range stores[1:] {
+			tiers = append(tiers, cache.Tier{
+				Remote: &cache.StoreRemote{Dir: dir, Archive: *archive},
+				NoPut:  *storeWrite != "all",
+			})
+		}
+		if c.Remote != nil {
+			tiers = append(tiers, cache.Tier{Remote: c.Remote})
+		}
+		c.Remote = tiers
+	}
 
-	h, err := hashFile(depDesc)
+	c.Dir, err = cache.StoreDir(*cacheDirFlag)
+	store := c.NamespaceDir()
+	if err == nil && len(shows) > 0 {
+		for _, s := range shows {
+			if s.label != "" && !*asJSON {
+				// the JSON names the entry by its key
+				fmt.Println("label:", s.label)
+			}
+			err := c.Show(os.Stdout, s.key, *asJSON)
+			if err != nil {
+				exitWith(err)
+			}
+		}
+		return
+	}
+	if err == nil && *doctor {
+		if cache.WriteChecks(os.Stdout, cache.Doctor(store, c.Remote)) {
+			exitWith("Critical checks failed")
+		}
+		return
+	}
+	if err == nil && *dryRun {
+		if _, errStat := os.Stat(store); os.IsNotExist(errStat) {
+			cache.Progress("would create cache dir", store)
+		}
+	} else if err == nil && !*readOnly {
+		err = cache.CreateStore(store)
+	}
 	if err != nil {
-		exitWith("Can't hash dependency description:", err)
+		exitWith("Cache dir problems: ", err)
+	}
+	if fs, err := cache.NetworkFS(store); err == nil && fs != "" {
+		msg := fmt.Sprintf("the cache dir %s is on a network filesystem (%s) - that is slow, and locking and atomic renames may not work on it. Keep it on a local disk", store, fs)
+		if *strictLocal {
+			exitWith("Cache dir problems: ", msg)
+		}
+		cache.Progress("Warning: ", msg)
 	}
 
-	depDir := path.Join(cacheStore, h)
+	if *migrateHash {
+		n, orphans, err := cache.MigrateHash(store, c.Hash, *pruneOrphans, *dryRun)
+		if err != nil {
+			exitWith("Error migrating the cache: ", err)
+		}
+		verb := "Rekeyed"
+		if *dryRun {
+			verb = "Would rekey"
+		}
+		cache.Progressf("%s %d entries to %s, %d orphaned", verb, n, c.Hash, len(orphans))
+		if len(orphans) > 0 && !*pruneOrphans {
+			cache.Progress("Rerun with -prune-orphans to remove the orphaned entries")
+		}
+		return
+	}
 
-	// pre build
-	if *force {
-		err := os.RemoveAll(outputdir)
-		if err != nil && err != os.ErrNotExist {
-			exitWith("Error trying to remove existing output dir", err)
+	if *gc {
+		reclaimed, err := cache.GC(store, cache.GCPolicy{MaxSize: c.MaxSize, MaxAge: maxAgeDur, DryRun: *dryRun})
+		if err != nil {
+			exitWith("Error tidying the cache: ", err)
 		}
-	} else {
-		_, err := os.Stat(outputdir)
-		if !os.IsNotExist(err) {
-			exitWith("output path '", outputdir, "' already exists - maybe rerun with `-f`")
+		if *dryRun {
+			fmt.Printf("Would reclaim %s\n", cache.FormatSize(reclaimed))
+		} else {
+			fmt.Printf("Reclaimed %s\n", cache.FormatSize(reclaimed))
 		}
+		return
 	}
 
-	cached, err := IsDir(depDir)
-	if err != nil {
-		exitWith("Error looking up cache dir", err)
+	if *readOnly {
+		cache.Progress("Read-only cache - nothing will be written to ", store)
+	} else if !*dryRun {
+		err = cache.CleanTmp(store)
+		if err != nil {
+			exitWith("Error cleaning up after earlier runs: ", err)
+		}
 	}
 
-	// build
-	start := time.Now()
-	if cached {
-		Progress("Found cached dependencies - installing those")
-		err = Install(depDir, outputdir, *symlink)
-	} else {
-		Progressf("Running `%s %s` and caching the output", cmd, strings.Join(args, " "))
-		err = GenerateAndCache(depDir, outputdir, cmd, args)
+	if maxAgeDur > 0 && (*dryRun || !*readOnly) {
+		err := cache.Expire(store, maxAgeDur, *dryRun)
+		if err != nil {
+			exitWith("Error removing expired entries: ", err)
+		}
+		if *clean {
+			return
+		}
 	}
 
-	if err != nil {
-		exitWith(err)
+	if *stats {
+		err := cache.Stats(os.Stdout, store, *asJSON)
+		if err != nil {
+			exitWith(err)
+		}
+		return
 	}
 
-	Progressf("Succeeded in %.2f sec", time.Now().Sub(start).Seconds())
-}
+	if *size {
+		err := cache.Size(os.Stdout, store, *asJSON)
+		if err != nil {
+			exitWith(err)
+		}
+		return
+	}
 
-func Install(from, to string, link bool) (err error) {
-	from, err = filepath.Abs(from)
-	if err != nil {
-		return err
+	if *list {
+		err := cache.List(os.Stdout, store, sinceDur, *asJSON)
+		if err != nil {
+			exitWith(err)
+		}
+		return
 	}
-	to, err = filepath.Abs(to)
-	if err != nil {
-		return err
+
+	if *clean {
+		if *dryRun {
+			fmt.Printf("Would wipe cache %q\n", store)
+			return
+		}
+		fmt.Printf("Wiping cache %q\n", store)
+		err := os.RemoveAll(store)
+		if err != nil {
+			exitWith(err)
+		}
+		return
 	}
 
-	if link {
-		// to is a symlink to from
-		err = os.Symlink(from, to)
-	} else {
-		err = Copy(from, to)
+	if *pinKey != "" || *unpinKey != "" {
+		key, pinned, verb := *pinKey, true, "Pinned"
+		if key == "" {
+			key, pinned, verb = *unpinKey, false, "Unpinned"
+		}
+		err := c.Pin(key, pinned)
+		if err != nil {
+			exitWith("Error pinning: ", err)
+		}
+		cache.Progress(verb, " ", key)
+		return
 	}
-	return err
-}
 
-func IsDir(d string) (bool, error) {
-	info, err := os.Stat(d)
-	if os.IsNotExist(err) {
-		return false, nil
+	if *exportKey != "" {
+		if flag.NArg() != 1 {
+			exitUsage("-export needs the file to write to")
+		}
+		f, err := os.Create(flag.Arg(0))
+		if err == nil {
+			err = c.Export(*exportKey, f)
+			if errClose := f.Close(); err == nil {
+				err = errClose
+			}
+		}
+		if err != nil {
+			os.Remove(flag.Arg(0))
+			exitWith("Error exporting: ", err)
+		}
+		return
 	}
-	if err != nil {
-		return false, err
+
+	if *importFile != "" {
+		f, err := os.Open(*importFile)
+		if err != nil {
+			exitWith("Error importing: ", err)
+		}
+		key, err := c.Import(f)
+		f.Close()
+		if err != nil {
+			exitWith("Error importing: ", err)
+		}
+		cache.Progress("Imported ", key)
+		return
 	}
 
-	return info.IsDir(), nil
+	if *invalidate != "" {
+		k := cache.KeySpec{Files: strings.Split(*invalidate, ","), Env: keyEnv, Tools: tools, Normalize: *normalize, FollowSymlinks: *followLinks, NoFollowSpecs: *noFollowSpec, Exclude: excludes, Salt: *salt, Version: *keyVersion}
+		if *keyCmd {
+			k.Cmd = flag.Args()
+		}
+		keys, err := k.Keys(c.Hash)
+		if err != nil {
+			exitWith(err)
+		}
+		for _, k := range keys {
+			if *dryRun {
+				fmt.Println("Would invalidate", k)
+				continue
+			}
+			err := cache.RemoveEntry(filepath.Join(store, k))
+			if err != nil {
+				exitWith(err)
+			}
+		}
 
-}
+		return
+	}
 
-func run(bin string, args ...string) error {
-	cmd := exec.Command(bin, args...)
-	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
-	return cmd.Run()
-}
+	deps, outs, args := resolveArgs(conf)
+	units := labeledUnits(outs, args)
+	if units == nil {
+		units = []unit{{outs: outs, cmd: args}}
+	}
+	if len(deps) == 0 && specOut == nil && *fixedKey == "" || len(outs) == 0 && len(labeled) == 0 ||
+		len(args) < 1 && len(labeled) == 0 && !*watchCheck && *fixedKey == "" && !*failOnMiss {
+		exitUsage("please supply both dependency description file, outputdir and the command to generate it")
+	}
+	storeDirs := []string{c.Dir}
+	if len(stores) > 1 {
+		storeDirs = append(storeDirs, stores[1:]...)
+	}
+	for _, u := range units {
+		for _, dir := range storeDirs {
+			if err := cache.CheckNesting(dir, u.outs); err != nil {
+				exitWith(err)
+			}
+		}
+	}
 
-func GenerateAndCache(cache, outputdir, cmd string, args []string) error {
-	err := run(cmd, args...)
-	if err != nil {
-		return err
+	base := cache.KeySpec{Files: deps, Env: keyEnv, Tools: tools, Normalize: *normalize, FollowSymlinks: *followLinks, NoFollowSpecs: *noFollowSpec, Exclude: excludes, Salt: *salt, Version: *keyVersion, Key: *fixedKey}
+	if specOut != nil {
+		base.SpecCmd, base.SpecOutput = strings.Fields(*specCmd), specOut
+	}
+	keyOf := func(u unit) cache.KeySpec {
+		k := base
+		k.Outputs, k.Label = u.outs, u.label
+		if *keyCmd {
+			k.Cmd = u.cmd
+		}
+		return k
 	}
-	return Copy(outputdir, cache)
-}
 
-func Copy(a, b string) error {
-	err := run("cp", "-R", a, b)
-	if err != nil {
-		errRm := os.RemoveAll(b)
-		if errRm != nil && !os.IsNotExist(errRm) {
-			return errRm
+	if *watchCheck {
+		anyStale := false
+		for _, u := range units {
+			stale, key, err := c.Stale(keyOf(u), u.outs)
+			if err != nil {
+				exitWith("Error checking outputs: ", err)
+			}
+			for _, s := range stale {
+				cache.Progressf("Warning: %s is stale - it was installed from %s, but the dependency description now has the key %s. Rerun with -f to reinstall", s.Output, s.Key, key)
+			}
+			anyStale = anyStale || len(stale) > 0
 		}
+		if anyStale && *strict {
+			exitWithCode(1, "Installed outputs are stale")
+		}
+		return
 	}
-	return err
-}
 
-func exitUsage(a ...interface{}) {
-	flag.Usage()
-	exitWith(a...)
+	if *dryRun {
+		for _, u := range units {
+			plan, err := c.Plan(keyOf(u), u.outs, u.cmd)
+			if err != nil {
+				exitWith("Error looking up cache dir: ", err)
+			}
+			if u.label != "" {
+				fmt.Println("label:", u.label)
+			}
+			plan.Print(os.Stdout)
+		}
+		return
+	}
+
+	if c.AsyncPush {
+		pushing = c
+	}
+	exitCode := 0
+	ensure := c.EnsureInstalled
+	if *warm {
+		ensure = c.Warm
+	}
+	// labeled outputs are entries of their own, each generated only if
+	// it isn't cached
+	cached := true
+	for _, u := range units {
+		if u.label != "" {
+			cache.Progressf("Output %s (%s)", u.label, u.outs[0])
+		}
+		hit, err := ensure(keyOf(u), u.outs, u.cmd)
+		cached = cached && hit
+		if err != nil && u.label != "" {
+			err = fmt.Errorf("output %s: %w", u.label, err)
+		}
+		var accepted *cache.AcceptedExitError
+		var cmdErr *cache.CommandError
+		if errors.As(err, &accepted) {
+			exitCode = accepted.Code
+		} else if errors.As(err, &cmdErr) {
+			exitWithCode(cmdErr.Code, err)
+		} else if err != nil {
+			exitWith(err)
+		}
+		if *lazyCopy && !*warm {
+			startLazyCopy(u.outs)
+		}
+	}
+	finishPushes()
+
+	status := "miss"
+	if cached {
+		status = "hit"
+	}
+	if *statusFile != "" {
+		err := os.WriteFile(*statusFile, []byte(status+"\n"), 0644)
+		if err != nil {
+			exitWith("Error writing status file: ", err)
+		}
+	}
+	if exitCode != 0 {
+		os.Exit(exitCode)
+	}
+	if !cached && *missExitCode != 0 {
+		os.Exit(*missExitCode)
+	}
 }
-func exitWith(a ...interface{}) {
-	fmt.Fprint(os.Stderr, append([]interface{}{"Error: "}, append(a, "\n")...)...)
-	os.Exit(1)
+
+// shownKey is an entry to -show or a key printed by -print-key, labeled
+// with -output.
+type shownKey struct {
+	label, key string
 }
 
-func hashFile(fname string) (hash string, err error) {
-	h := sha1.New()
-	f, err := os.Open(fname)
-	if err != nil {
-		return "", err
+// printKeys prints the -print-key keys, hashed with algo, as text or with
+// -json as JSON versioned by cache.SchemaVersion.
+func printKeys(algo string, keys []shownKey) {
+	if !*asJSON {
+		for _, k := range keys {
+			if k.label != "" {
+				fmt.Println(k.label, k.key)
+			} else {
+				fmt.Println(k.key)
+			}
+		}
+		return
 	}
-	defer f.Close()
 
-	_, err = io.Copy(h, f)
+	type printedKey struct {
+		Label string `json:"label,omitempty"`
+		Key   string `json:"key"`
+	}
+	out := struct {
+		SchemaVersion int          `json:"schemaVersion"`
+		Hash          string       `json:"hash"`
+		Keys          []printedKey `json:"keys"`
+	}{SchemaVersion: cache.SchemaVersion, Hash: algo}
+	for _, k := range keys {
+		out.Keys = append(out.Keys, printedKey{k.label, k.key})
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	err := enc.Encode(out)
 	if err != nil {
-		return "", err
+		exitWith(err)
 	}
-
-	return fmt.Sprintf("%x", h.Sum(nil)), nil
 }
 
-func ensureDir(dir string) error {
+// unit is a set of outputs generated by one command and cached as one
+// entry. The label names labeled outputs (-output), of which there may be
+// several per run.
+type unit struct {
+	label string
+	outs  []string
+	cmd   []string
+}
 
-	info, err := os.Stat(dir)
-	if os.IsNotExist(err) {
-		Progress("creating cache dir", dir)
-		return os.MkdirAll(dir, 0750)
+// labeledUnits returns the outputs given with -output and their -generate
+// commands, or nil if there are none. outs and args are those left over
+// from the command line and config, which must be empty then.
+func labeledUnits(outs, args []string) []unit {
+	if len(labeled) == 0 && len(generates) == 0 {
+		return nil
 	}
-	if err != nil {
-		return err
+	if len(outs) > 0 || len(args) > 0 {
+		exitUsage("-output and -generate replace <dir>, -out and the command")
 	}
-	if !info.IsDir() {
-		return errors.New(dir + " exists but is not a dir")
+	if *fixedKey != "" {
+		exitUsage("-key gives all outputs the same key, it can't be combined with -output")
 	}
-	return nil
+	cmds := map[string][]string{}
+	for _, g := range generates {
+		label, cmd, ok := strings.Cut(g, "=")
+		if !ok || label == "" || len(strings.Fields(cmd)) == 0 {
+			exitUsage("bad -generate ", g, ", want label=command")
+		}
+		if cmds[label] != nil {
+			exitUsage("-generate given twice for ", label)
+		}
+		cmds[label] = strings.Fields(cmd)
+	}
+	var units []unit
+	seen := map[string]bool{}
+	for _, o := range labeled {
+		label, dir, ok := strings.Cut(o, "=")
+		if !ok || label == "" || dir == "" {
+			exitUsage("bad -output ", o, ", want label=dir")
+		}
+		if seen[label] {
+			exitUsage("-output given twice for ", label)
+		}
+		if cmds[label] == nil {
+			exitUsage("no -generate for output ", label)
+		}
+		seen[label] = true
+		units = append(units, unit{label: label, outs: []string{dir}, cmd: cmds[label]})
+	}
+	for label := range cmds {
+		if !seen[label] {
+			exitUsage("no -output for -generate ", label)
+		}
+	}
+	return units
 }
 
-func cacheDir(dirName string) (dir string, err error) {
+func installMode() cache.InstallMode {
+	switch {
+	case *hardlink:
+		return cache.InstallHardlink
+	case *symlink && (*merge || len(rewrites) > 0) && !flagSet("symlink"):
+		// symlinking is just the default, merging and rewriting copy
+		// instead
+		return cache.InstallCopy
+	case *symlink:
+		return cache.InstallSymlink
+	}
+	return cache.InstallCopy
+}
 
-	if dirName == "" {
-		dir = dirName
+// resolveArgs returns the spec files, outputs and command from the flags
+// and positional args, falling back to conf for those not given. Any may
+// come back empty.
+func resolveArgs(conf *Config) (specs, outputs stringList, args []string) {
+	specs, outputs, args = deps, outs, flag.Args()
+	fromArgs := len(specs) == 0 && len(globs) == 0 && *specCmd == "" && *fixedKey == ""
+	if len(args) == 0 {
+		// spec, outputs and command all from the config then
+		if fromArgs {
+			specs = stringList(conf.Deps)
+		}
+		if len(outputs) == 0 {
+			outputs = stringList(conf.Out)
+		}
+		args = conf.Command
+	}
+	if fromArgs && len(specs) == 0 && len(args) > 0 {
+		specs, args = stringList{args[0]}, args[1:]
+	}
+	if len(globs) > 0 {
+		matches, err := cache.ExpandGlobs(globs)
+		if err != nil {
+			exitWith(err)
+		}
+		specs = append(specs, matches...)
 	}
 
-	if dir == "" {
-		dir = os.Getenv("CACHE_DIR")
+	if len(outputs) == 0 && len(args) > 0 {
+		outputs, args = stringList{args[0]}, args[1:]
 	}
+	return specs, outputs, args
+}
 
-	if dir == "" {
-		home := os.Getenv("HOME")
-		if home == "" {
-			// os/user uses cgo. Fails under cross-compile.
-			u, err := user.Current()
-			if err != nil {
-				return "", err
-			}
-			home = u.HomeDir
+// flagSet reports whether the flag name was given on the command line.
+func flagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
 		}
-		dir = path.Join(home, ".dep-cache")
-	}
+	})
+	return set
+}
+
+func exitUsage(a ...interface{}) {
+	flag.Usage()
+	exitWith(a...)
+}
+
+// exitInternal is the exit code for failures of our own rather than of the
+// command, so the two can be told apart.
+const exitInternal = 125
+
+// pushing is the cache whose -async-push uploads are waited for on exit.
+var pushing *cache.Cache
+
+// lazyCopyEnv passes the outputs to copy to the background process started
+// for -lazy-copy, a copy of this one.
+const lazyCopyEnv = "CACHE_PKGS_LAZY_COPY"
 
-	err = ensureDir(dir)
+// startLazyCopy starts the -lazy-copy of those of outs that were installed
+// as symlinks. It isn't waited for.
+func startLazyCopy(outs []string) {
+	var links []string
+	for _, out := range outs {
+		info, err := os.Lstat(out)
+		if err != nil || info.Mode()&os.ModeSymlink == 0 {
+			// generated on a miss, already a copy
+			continue
+		}
+		abs, err := filepath.Abs(out)
+		if err != nil {
+			cache.Progressf("Warning: -lazy-copy of %s failed, it stays a symlink to the cache: %v", out, err)
+			continue
+		}
+		links = append(links, abs)
+	}
+	if len(links) == 0 {
+		return
+	}
+	exe, err := os.Executable()
+	if err == nil {
+		cmd := exec.Command(exe)
+		cmd.Env = append(os.Environ(), lazyCopyEnv+"="+strings.Join(links, string(os.PathListSeparator)))
+		// for its warnings
+		cmd.Stderr = os.Stderr
+		err = cmd.Start()
+		if err == nil {
+			cmd.Process.Release()
+		}
+	}
 	if err != nil {
-		return "", err
+		cache.Progressf("Warning: can't start -lazy-copy, %s stays a symlink to the cache: %v", strings.Join(links, ", "), err)
+	}
+}
+
+// materialize is the background process of -lazy-copy, replacing the
+// symlinks outs with copies of the entries they link to.
+func materialize(outs []string) {
+	for _, out := range outs {
+		err := cache.Materialize(out)
+		if err != nil {
+			cache.Progressf("Warning: -lazy-copy of %s failed, it stays a symlink to the cache: %v", out, err)
+		}
 	}
-	return dir, nil
 }
 
-func Progressf(format string, a ...interface{}) {
-	ProgressPrint(fmt.Sprintf(format, a...))
+// finishPushes waits for the -async-push uploads to finish, up to
+// -push-wait.
+func finishPushes() {
+	if pushing == nil {
+		return
+	}
+	c := pushing
+	pushing = nil
+	if !c.WaitPushes(*pushWait) {
+		cache.Progressf("Warning: gave up on pushing to %s after %v", c.Remote, *pushWait)
+	}
 }
 
-func Progress(a ...interface{}) {
-	ProgressPrint(fmt.Sprint(a...))
+func exitWith(a ...interface{}) {
+	exitWithCode(exitInternal, a...)
 }
 
-func ProgressPrint(s string) {
-	prefix := os.Getenv("PRETTY_PREFIX")
-	fmt.Fprintf(os.Stderr, "%s%s\n", prefix, s)
+func exitWithCode(code int, a ...interface{}) {
+	finishPushes()
+	if *logFormat == cache.LogJSON {
+		cache.LogEvent(cache.Event{Event: "error", Error: fmt.Sprint(a...)})
+	} else {
+		fmt.Fprint(os.Stderr, append([]interface{}{"Error: "}, append(a, "\n")...)...)
+	}
+	os.Exit(code)
 }